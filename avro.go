@@ -0,0 +1,105 @@
+package pxld
+
+import (
+	_ "embed" // for AvroSchema
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	// AvroCodecNull writes blocks uncompressed
+	AvroCodecNull = "null"
+	// AvroCodecDeflate compresses blocks with deflate
+	AvroCodecDeflate = "deflate"
+	// AvroCodecSnappy compresses blocks with snappy
+	AvroCodecSnappy = "snappy"
+
+	// avroBlockSize is the size of uncompressed data after which a block is written
+	avroBlockSize = 64 << 10
+)
+
+var (
+	// AvroSchema is the Avro schema of a log line written by AvroWriter, published as logline.avsc
+	//go:embed logline.avsc
+	AvroSchema string
+)
+
+// AvroWriter writes log lines as an Avro object container file with AvroSchema embedded in its header.
+// The header is written by NewAvroWriter, then log lines are buffered and written in blocks,
+// so Close must be called to write the last one.
+type AvroWriter struct {
+	ocf *goavro.OCFWriter
+
+	block []interface{}
+	size  int // estimated encoded size of block
+}
+
+// NewAvroWriter returns a new writer that writes to w, compressing blocks with one of the AvroCodec constants
+func NewAvroWriter(w io.Writer, codec string) (*AvroWriter, error) {
+	switch codec {
+	case AvroCodecNull, AvroCodecDeflate, AvroCodecSnappy:
+	default:
+		return nil, fmt.Errorf("unknown avro codec %s", codec)
+	}
+
+	ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               w,
+		Schema:          AvroSchema,
+		CompressionName: codec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AvroWriter{ocf: ocf}, nil
+}
+
+// Write adds a log line to the current block, writing the block once it is big enough
+func (w *AvroWriter) Write(l *LogLine) error {
+	var serverAddr interface{}
+	if l.ServerAddr != "" {
+		serverAddr = goavro.Union("string", l.ServerAddr)
+	}
+
+	w.block = append(w.block, map[string]interface{}{
+		"thread_id":    int64(l.ThreadID),
+		"username":     l.Username,
+		"schema":       l.Schema,
+		"client_addr":  l.ClientAddr,
+		"hid":          int64(l.HID),
+		"server_addr":  serverAddr,
+		"start_at":     l.StartAt.UnixNano() / int64(time.Microsecond),
+		"end_at":       l.EndAt.UnixNano() / int64(time.Microsecond),
+		"duration_ns":  int64(l.Duration),
+		"query_digest": l.QueryDigest,
+		"query":        l.Query,
+	})
+
+	// strings and about 8 bytes a number
+	w.size += len(l.Username) + len(l.Schema) + len(l.ClientAddr) + len(l.ServerAddr) + len(l.QueryDigest) + len(l.Query) + 64
+
+	if w.size >= avroBlockSize {
+		return w.writeBlock()
+	}
+
+	return nil
+}
+
+// Close writes the last block
+func (w *AvroWriter) Close() error {
+	return w.writeBlock()
+}
+
+func (w *AvroWriter) writeBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	err := w.ocf.Append(w.block)
+	w.block, w.size = nil, 0
+
+	return err
+}
@@ -0,0 +1,128 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// avroV1Fields are the fields of the first published schema, later fields must have a default
+var avroV1Fields = []string{
+	"thread_id",
+	"username",
+	"schema",
+	"client_addr",
+	"hid",
+	"server_addr",
+	"start_at",
+	"end_at",
+	"duration_ns",
+	"query_digest",
+	"query",
+}
+
+func TestAvroSchemaEvolution(t *testing.T) {
+	var schema struct {
+		Fields []map[string]interface{} `json:"fields"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(AvroSchema), &schema))
+	require.True(t, len(schema.Fields) >= len(avroV1Fields))
+
+	// existing fields are never removed, renamed or reordered
+	for i, name := range avroV1Fields {
+		require.Equal(t, name, schema.Fields[i]["name"])
+	}
+
+	// new fields are appended with a default so old files can be read with the new schema
+	for _, f := range schema.Fields[len(avroV1Fields):] {
+		_, ok := f["default"]
+		require.True(t, ok, "field %s has no default", f["name"])
+	}
+}
+
+func TestAvroWriter(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	noServer := *line
+	noServer.HID = ^uint64(0)
+	noServer.ServerAddr = ""
+
+	for _, codec := range []string{AvroCodecNull, AvroCodecDeflate, AvroCodecSnappy} {
+		buf := &bytes.Buffer{}
+		w, err := NewAvroWriter(buf, codec)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(line))
+		require.NoError(t, w.Write(&noServer))
+		require.NoError(t, w.Close())
+
+		r, err := goavro.NewOCFReader(buf)
+		require.NoError(t, err)
+		require.Equal(t, codec, r.CompressionName())
+
+		records := []map[string]interface{}{}
+		for r.Scan() {
+			record, err := r.Read()
+			require.NoError(t, err)
+			records = append(records, record.(map[string]interface{}))
+		}
+		require.NoError(t, r.Err())
+		require.Len(t, records, 2)
+
+		require.Equal(t, int64(21), records[0]["thread_id"])
+		require.Equal(t, "didasy", records[0]["username"])
+		require.Equal(t, int64(1), records[0]["hid"])
+		require.Equal(t, map[string]interface{}{"string": "127.0.0.1:3306"}, records[0]["server_addr"])
+		require.True(t, tm.Equal(records[0]["start_at"].(time.Time)))
+		require.Equal(t, "select * from test", records[0]["query"])
+
+		require.Equal(t, int64(-1), records[1]["hid"])
+		require.Nil(t, records[1]["server_addr"])
+	}
+}
+
+func TestAvroWriterManyBlocks(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewAvroWriter(buf, AvroCodecDeflate)
+	require.NoError(t, err)
+
+	n := avroBlockSize/len(line.Query) + 10
+	for i := 0; i < n; i++ {
+		require.NoError(t, w.Write(line))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := goavro.NewOCFReader(buf)
+	require.NoError(t, err)
+
+	count := 0
+	for r.Scan() {
+		_, err := r.Read()
+		require.NoError(t, err)
+		count++
+	}
+	require.Equal(t, n, count)
+}
+
+func TestAvroWriterEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewAvroWriter(buf, AvroCodecSnappy)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// still a readable file, with the schema in its header
+	r, err := goavro.NewOCFReader(buf)
+	require.NoError(t, err)
+	require.False(t, r.Scan())
+	require.NoError(t, r.Err())
+}
+
+func TestAvroWriterNegative(t *testing.T) {
+	_, err := NewAvroWriter(&bytes.Buffer{}, "lzma")
+	require.Error(t, err)
+}
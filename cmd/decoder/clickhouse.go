@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	clickhouseFormatJSONEachRow = "JSONEachRow"
+	clickhouseFormatRowBinary   = "RowBinary"
+
+	// clickhouseTimeLayout is how DateTime64(6) values are written in JSONEachRow
+	clickhouseTimeLayout = "2006-01-02 15:04:05.000000"
+)
+
+var (
+	// clickhouseColumns are the columns of the table created by clickhouseCreateTable,
+	// in the order RowBinary rows are encoded
+	clickhouseColumns = []struct {
+		name string
+		typ  string
+	}{
+		{"thread_id", "UInt64"},
+		{"username", "LowCardinality(String)"},
+		{"schema", "LowCardinality(String)"},
+		{"client_addr", "String"},
+		{"hid", "UInt64"},
+		{"server_addr", "LowCardinality(String)"},
+		{"start_at", "DateTime64(6, 'UTC')"},
+		{"end_at", "DateTime64(6, 'UTC')"},
+		{"duration_ns", "Int64"},
+		{"query_digest", "String"},
+		{"query", "String CODEC(ZSTD)"},
+	}
+)
+
+// clickhouseCreateTable returns the recommended CREATE TABLE statement of table, ordered by digest
+// then start time so the queries of a digest are stored and read together
+func clickhouseCreateTable(table string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "CREATE TABLE IF NOT EXISTS %s\n(\n", table)
+	for i, c := range clickhouseColumns {
+		sep := ","
+		if i == len(clickhouseColumns)-1 {
+			sep = ""
+		}
+
+		fmt.Fprintf(b, "    `%s` %s%s\n", c.name, c.typ, sep)
+	}
+	b.WriteString(")\n")
+	b.WriteString("ENGINE = MergeTree\n")
+	b.WriteString("PARTITION BY toYYYYMM(start_at)\n")
+	b.WriteString("ORDER BY (query_digest, start_at);\n")
+
+	return b.String()
+}
+
+// clickhouseInsert returns the INSERT statement of table, listing clickhouseColumns so a table
+// with more columns, or with them in another order, is inserted into too
+func clickhouseInsert(table, format string) string {
+	names := make([]string, 0, len(clickhouseColumns))
+	for _, c := range clickhouseColumns {
+		names = append(names, "`"+c.name+"`")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) FORMAT %s", table, strings.Join(names, ", "), format)
+}
+
+// clickhouseSink inserts log lines into a ClickHouse table through the HTTP interface. Rows are batched
+// until batchSize are pending, so Close must be called to insert the last batch.
+type clickhouseSink struct {
+	url       string
+	format    string
+	batchSize int
+	retries   int
+	backoff   time.Duration
+	cli       *http.Client
+
+	buf  bytes.Buffer
+	rows int
+}
+
+func newClickhouseSink(baseURL, table, format string, batchSize, retries int) (*clickhouseSink, error) {
+	if !isValidURL(baseURL) {
+		return nil, fmt.Errorf("invalid clickhouse url %s", baseURL)
+	}
+	if table == "" {
+		return nil, fmt.Errorf("the clickhouse table is empty")
+	}
+
+	switch format {
+	case clickhouseFormatJSONEachRow, clickhouseFormatRowBinary:
+	default:
+		return nil, fmt.Errorf("unknown clickhouse format %s", format)
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("query", clickhouseInsert(table, format))
+	u.RawQuery = q.Encode()
+
+	return &clickhouseSink{
+		url:       u.String(),
+		format:    format,
+		batchSize: batchSize,
+		retries:   retries,
+		backoff:   time.Second,
+		cli: &http.Client{
+			Timeout: time.Minute,
+		},
+	}, nil
+}
+
+// Write encodes a log line into the current batch, inserting the batch once it is full
+func (s *clickhouseSink) Write(l *pxld.LogLine) error {
+	if s.format == clickhouseFormatRowBinary {
+		putClickhouseRow(&s.buf, l)
+	} else {
+		raw, err := json.Marshal(map[string]interface{}{
+			"thread_id":    l.ThreadID,
+			"username":     l.Username,
+			"schema":       l.Schema,
+			"client_addr":  l.ClientAddr,
+			"hid":          l.HID,
+			"server_addr":  l.ServerAddr,
+			"start_at":     l.StartAt.UTC().Format(clickhouseTimeLayout),
+			"end_at":       l.EndAt.UTC().Format(clickhouseTimeLayout),
+			"duration_ns":  int64(l.Duration),
+			"query_digest": l.QueryDigest,
+			"query":        l.Query,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal to JSON: %v", err)
+		}
+
+		s.buf.Write(raw)
+		s.buf.WriteByte('\n')
+	}
+
+	s.rows++
+	if s.rows >= s.batchSize {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// Close inserts the last batch
+func (s *clickhouseSink) Close() error {
+	return s.flush()
+}
+
+func (s *clickhouseSink) flush() error {
+	if s.rows == 0 {
+		return nil
+	}
+
+	body := append([]byte{}, s.buf.Bytes()...)
+	s.buf.Reset()
+	s.rows = 0
+
+	return withRetries(s.retries, s.backoff, func() error {
+		res, err := s.cli.Post(s.url, "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= http.StatusBadRequest {
+			raw, _ := ioutil.ReadAll(res.Body)
+			err = fmt.Errorf("invalid response status code %d: %s", res.StatusCode, truncate(strings.TrimSpace(string(raw)), 512))
+			if !isRetryableStatus(res.StatusCode) {
+				return permanentError{err}
+			}
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+// putClickhouseRow encodes a log line in RowBinary, in the order of clickhouseColumns
+func putClickhouseRow(b *bytes.Buffer, l *pxld.LogLine) {
+	raw := make([]byte, binary.MaxVarintLen64)
+
+	putUint64 := func(n uint64) {
+		binary.LittleEndian.PutUint64(raw, n)
+		b.Write(raw[:8])
+	}
+	putString := func(s string) {
+		b.Write(raw[:binary.PutUvarint(raw, uint64(len(s)))])
+		b.WriteString(s)
+	}
+
+	putUint64(l.ThreadID)
+	putString(l.Username)
+	putString(l.Schema)
+	putString(l.ClientAddr)
+	putUint64(l.HID)
+	putString(l.ServerAddr)
+	putUint64(uint64(l.StartAt.UnixNano() / int64(time.Microsecond)))
+	putUint64(uint64(l.EndAt.UnixNano() / int64(time.Microsecond)))
+	putUint64(uint64(l.Duration))
+	putString(l.QueryDigest)
+	putString(l.Query)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickhouseSinkJSONEachRow(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "INSERT INTO logs.queries (`thread_id`, `username`, `schema`, `client_addr`, `hid`, `server_addr`, `start_at`, `end_at`, `duration_ns`, `query_digest`, `query`) FORMAT JSONEachRow", r.URL.Query().Get("query"))
+
+		raw, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(raw))
+	}))
+	defer srv.Close()
+
+	s, err := newClickhouseSink(srv.URL, "logs.queries", clickhouseFormatJSONEachRow, 2, 0)
+	require.NoError(t, err)
+
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// a full batch then the rest on Close
+	require.Len(t, bodies, 2)
+
+	rows := []map[string]interface{}{}
+	sc := bufio.NewScanner(strings.NewReader(bodies[0] + bodies[1]))
+	for sc.Scan() {
+		row := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	require.Len(t, rows, 3)
+
+	// every column of the table is there
+	require.Len(t, rows[0], len(clickhouseColumns))
+	require.Equal(t, "2019-04-10 08:08:00.727354", rows[0]["start_at"])
+	require.Equal(t, "didasy", rows[0]["username"])
+	require.Equal(t, "0x426F13B3371DDF38", rows[0]["query_digest"])
+}
+
+func TestClickhouseSinkRowBinary(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "INSERT INTO proxysql_queries (`thread_id`, `username`, `schema`, `client_addr`, `hid`, `server_addr`, `start_at`, `end_at`, `duration_ns`, `query_digest`, `query`) FORMAT RowBinary", r.URL.Query().Get("query"))
+
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s, err := newClickhouseSink(srv.URL, "proxysql_queries", clickhouseFormatRowBinary, 10, 0)
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+
+	r := bytes.NewReader(body)
+	readUint64 := func() uint64 {
+		var n uint64
+		require.NoError(t, binary.Read(r, binary.LittleEndian, &n))
+		return n
+	}
+	readString := func() string {
+		n, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+		raw := make([]byte, n)
+		_, err = r.Read(raw)
+		require.NoError(t, err)
+		return string(raw)
+	}
+
+	require.Equal(t, l.ThreadID, readUint64())
+	require.Equal(t, l.Username, readString())
+	require.Equal(t, l.Schema, readString())
+	require.Equal(t, l.ClientAddr, readString())
+	require.Equal(t, l.HID, readUint64())
+	require.Equal(t, l.ServerAddr, readString())
+	require.Equal(t, uint64(l.StartAt.UnixNano()/int64(time.Microsecond)), readUint64())
+	require.Equal(t, uint64(l.EndAt.UnixNano()/int64(time.Microsecond)), readUint64())
+	require.Equal(t, uint64(l.Duration), readUint64())
+	require.Equal(t, l.QueryDigest, readString())
+	require.Equal(t, l.Query, readString())
+	require.Zero(t, r.Len())
+}
+
+func TestClickhouseSinkNegative(t *testing.T) {
+	_, err := newClickhouseSink("localhost:8123", "proxysql_queries", clickhouseFormatRowBinary, 1, 0)
+	require.Error(t, err)
+
+	_, err = newClickhouseSink("http://localhost:8123", "", clickhouseFormatRowBinary, 1, 0)
+	require.Error(t, err)
+
+	_, err = newClickhouseSink("http://localhost:8123", "proxysql_queries", "CSV", 1, 0)
+	require.Error(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. DB::Exception: Table default.proxysql_queries does not exist", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	s, err := newClickhouseSink(srv.URL, "proxysql_queries", clickhouseFormatRowBinary, 1, 3)
+	require.NoError(t, err)
+
+	err = s.Write(testESLines(t)[0])
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not exist")
+}
+
+func TestClickhouseCreateTable(t *testing.T) {
+	ddl := clickhouseCreateTable("logs.queries")
+
+	require.True(t, strings.HasPrefix(ddl, "CREATE TABLE IF NOT EXISTS logs.queries\n"))
+	require.Contains(t, ddl, "`username` LowCardinality(String),\n")
+	require.Contains(t, ddl, "`query` String CODEC(ZSTD)\n)")
+	require.Contains(t, ddl, "ORDER BY (query_digest, start_at);")
+}
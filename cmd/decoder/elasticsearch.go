@@ -0,0 +1,245 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// esAction is a single index action of a _bulk request, its metadata line then its document line
+type esAction struct {
+	meta []byte
+	doc  []byte
+}
+
+// esBulkResponse is the part of a _bulk response needed to find the failed actions
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// esSink indexes log lines into Elasticsearch or OpenSearch with the _bulk API. Lines are batched until
+// batchSize lines or batchBytes bytes are pending, so Close must be called to send the last batch.
+// Every document id is derived from where its line comes from, so sending the same lines again
+// overwrites the same documents instead of duplicating them.
+type esSink struct {
+	url          string
+	indexPattern string
+	source       string
+	batchSize    int
+	batchBytes   int
+	retries      int
+	backoff      time.Duration
+	cli          *http.Client
+
+	pending []esAction
+	size    int
+}
+
+func newESSink(url, indexPattern, source string, batchSize, batchBytes, retries int) (*esSink, error) {
+	if !isValidURL(url) {
+		return nil, fmt.Errorf("invalid elasticsearch url %s", url)
+	}
+	if indexPattern == "" {
+		return nil, fmt.Errorf("the elasticsearch index pattern is empty")
+	}
+
+	return &esSink{
+		url:          strings.TrimSuffix(url, "/") + "/_bulk",
+		indexPattern: indexPattern,
+		source:       source,
+		batchSize:    batchSize,
+		batchBytes:   batchBytes,
+		retries:      retries,
+		backoff:      time.Second,
+		cli: &http.Client{
+			Timeout: time.Minute,
+		},
+	}, nil
+}
+
+// Write adds an index action of a log line to the current batch, sending the batch once it is full
+func (s *esSink) Write(l *pxld.LogLine) error {
+	meta, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{
+			"_index": expandTimePattern(s.indexPattern, l.StartAt),
+			"_id":    docID(s.source, l),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal to JSON: %v", err)
+	}
+
+	s.pending = append(s.pending, esAction{meta: meta, doc: doc})
+	s.size += len(meta) + len(doc) + 2
+
+	if len(s.pending) >= s.batchSize || s.size >= s.batchBytes {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// Close sends the last batch
+func (s *esSink) Close() error {
+	return s.flush()
+}
+
+// flush sends the pending actions, retrying the whole batch on request failures and only
+// the rejected actions when Elasticsearch answers they are worth retrying
+func (s *esSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	batch := s.pending
+	s.pending, s.size = nil, 0
+
+	return withRetries(s.retries, s.backoff, func() error {
+		retry, err := s.bulk(batch)
+		if err != nil {
+			return err
+		}
+
+		if len(retry) > 0 {
+			batch = retry
+			return fmt.Errorf("%d bulk actions were rejected", len(retry))
+		}
+
+		return nil
+	})
+}
+
+// bulk sends a single _bulk request, returning the actions that failed but can be retried.
+// Actions failing for good, e.g. on a mapping conflict, are logged and dropped.
+func (s *esSink) bulk(batch []esAction) ([]esAction, error) {
+	body := &bytes.Buffer{}
+	for _, a := range batch {
+		body.Write(a.meta)
+		body.WriteByte('\n')
+		body.Write(a.doc)
+		body.WriteByte('\n')
+	}
+
+	res, err := s.cli.Post(s.url, "application/x-ndjson", body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("invalid response status code %d: %s", res.StatusCode, truncate(string(raw), 512))
+		if !isRetryableStatus(res.StatusCode) {
+			return nil, permanentError{err}
+		}
+
+		return nil, err
+	}
+
+	bres := &esBulkResponse{}
+	err = json.Unmarshal(raw, bres)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bulk response: %v", err)
+	}
+
+	if !bres.Errors {
+		return nil, nil
+	}
+
+	if len(bres.Items) != len(batch) {
+		return nil, fmt.Errorf("bulk response has %d items for %d actions", len(bres.Items), len(batch))
+	}
+
+	var retry []esAction
+	for i, item := range bres.Items {
+		for _, result := range item {
+			if result.Status < http.StatusBadRequest {
+				continue
+			}
+
+			if isRetryableStatus(result.Status) {
+				retry = append(retry, batch[i])
+				continue
+			}
+
+			log.Errorf("Dropped log line rejected by elasticsearch with status %d: %s", result.Status, result.Error)
+		}
+	}
+
+	return retry, nil
+}
+
+// isRetryableStatus reports whether a request failing with this status code may succeed later
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// docID derives a stable id from the source of a log line, its byte offset in the source and its message,
+// the message being there for sources without meaningful offsets like server mode chunks
+func docID(source string, l *pxld.LogLine) string {
+	h := sha1.New()
+	h.Write([]byte(source))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(l.Offset, 10)))
+	h.Write([]byte{0})
+	h.Write(l.RawMessage)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// expandTimePattern replaces every {layout} of pattern by t in UTC formatted with the Go time layout,
+// e.g. proxysql-{2006.01.02} becomes proxysql-2019.04.10
+func expandTimePattern(pattern string, t time.Time) string {
+	b := &strings.Builder{}
+	for {
+		start := strings.IndexByte(pattern, '{')
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(pattern[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		b.WriteString(pattern[:start])
+		b.WriteString(t.UTC().Format(pattern[start+1 : end]))
+		pattern = pattern[end+1:]
+	}
+	b.WriteString(pattern)
+
+	return b.String()
+}
+
+// truncate cuts s to at most n bytes, to keep error messages short
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n] + "..."
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+// fakeES is a stand-in for the _bulk API, keeping the indexed documents by index and id
+type fakeES struct {
+	mu       sync.Mutex
+	docs     map[string]map[string]json.RawMessage
+	requests int
+
+	// itemStatus answers every action with a status, 201 when nil
+	itemStatus func(request, item int) int
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	f.requests++
+
+	type result struct {
+		Status int         `json:"status"`
+		Error  interface{} `json:"error,omitempty"`
+	}
+	res := struct {
+		Errors bool                `json:"errors"`
+		Items  []map[string]result `json:"items"`
+	}{}
+
+	s := bufio.NewScanner(r.Body)
+	for i := 0; s.Scan(); i++ {
+		meta := struct {
+			Index struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"index"`
+		}{}
+		if err := json.Unmarshal(s.Bytes(), &meta); err != nil || !s.Scan() {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		status := http.StatusCreated
+		if f.itemStatus != nil {
+			status = f.itemStatus(f.requests, i)
+		}
+
+		if status >= http.StatusBadRequest {
+			res.Errors = true
+			res.Items = append(res.Items, map[string]result{"index": {Status: status, Error: map[string]string{"type": "test"}}})
+			continue
+		}
+
+		if f.docs[meta.Index.Index] == nil {
+			f.docs[meta.Index.Index] = map[string]json.RawMessage{}
+		}
+		f.docs[meta.Index.Index][meta.Index.ID] = append(json.RawMessage{}, s.Bytes()...)
+		res.Items = append(res.Items, map[string]result{"index": {Status: status}})
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeES) count() int {
+	n := 0
+	for _, docs := range f.docs {
+		n += len(docs)
+	}
+
+	return n
+}
+
+func testESLines(t *testing.T) []*pxld.LogLine {
+	data := append(append(append([]byte{}, testData...), testData...), testData...)
+	logs, err := pxld.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	return logs
+}
+
+func TestESSink(t *testing.T) {
+	es := &fakeES{docs: map[string]map[string]json.RawMessage{}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	s, err := newESSink(srv.URL, "proxysql-{2006.01.02}", "queries.log", 2, 1<<20, 0)
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// a full batch then the rest on Close
+	require.Equal(t, 2, es.requests)
+	require.Len(t, es.docs, 1)
+	require.Len(t, es.docs["proxysql-2019.04.10"], 3)
+
+	doc := es.docs["proxysql-2019.04.10"][docID("queries.log", logs[0])]
+	raw, err := json.Marshal(logs[0])
+	require.NoError(t, err)
+	require.JSONEq(t, string(raw), string(doc))
+
+	// sending the same lines again overwrites the same documents
+	s, err = newESSink(srv.URL, "proxysql-{2006.01.02}", "queries.log", 2, 1<<20, 0)
+	require.NoError(t, err)
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, 3, es.count())
+}
+
+func TestESSinkRetries(t *testing.T) {
+	es := &fakeES{
+		docs: map[string]map[string]json.RawMessage{},
+		itemStatus: func(request, item int) int {
+			switch {
+			case request == 1 && item == 0:
+				return http.StatusTooManyRequests
+			case item == 1:
+				// a mapping error is never retried
+				return http.StatusBadRequest
+			}
+
+			return http.StatusCreated
+		},
+	}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	s, err := newESSink(srv.URL, "proxysql", "queries.log", 10, 1<<20, 2)
+	require.NoError(t, err)
+	s.backoff = time.Millisecond
+
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// only the rejected line is sent again
+	require.Equal(t, 2, es.requests)
+	require.Equal(t, 2, es.count())
+}
+
+func TestESSinkNegative(t *testing.T) {
+	_, err := newESSink("/not/a/url", "proxysql", "", 1, 1, 0)
+	require.Error(t, err)
+
+	_, err = newESSink("http://localhost:9200", "", "", 1, 1, 0)
+	require.Error(t, err)
+
+	requests := 0
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "failed", status)
+	}))
+	defer srv.Close()
+
+	s, err := newESSink(srv.URL, "proxysql", "", 1, 1<<20, 2)
+	require.NoError(t, err)
+	s.backoff = time.Millisecond
+
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 3, requests)
+
+	// client errors are not retried
+	requests = 0
+	status = http.StatusForbidden
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 1, requests)
+}
+
+func TestDocID(t *testing.T) {
+	logs := testESLines(t)
+
+	// the same message at another offset or from another source is another document
+	require.Equal(t, docID("a", logs[0]), docID("a", logs[0]))
+	require.NotEqual(t, docID("a", logs[0]), docID("a", logs[1]))
+	require.NotEqual(t, docID("a", logs[0]), docID("b", logs[0]))
+	require.Len(t, docID("a", logs[0]), 40)
+}
+
+func TestExpandTimePattern(t *testing.T) {
+	tm := time.Date(2019, 4, 10, 15, 8, 0, 0, time.FixedZone("WIB", 7*3600))
+
+	for pattern, expected := range map[string]string{
+		"proxysql":                   "proxysql",
+		"proxysql-{2006.01.02}":      "proxysql-2019.04.10",
+		"{2006}-proxysql-{01}-{15}h": "2019-proxysql-04-08h",
+		"proxysql-{2006":             "proxysql-{2006",
+	} {
+		require.Equal(t, expected, expandTimePattern(pattern, tm), fmt.Sprintf("pattern %s", pattern))
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// httpMaxRetryAfter bounds how long a Retry-After header can make the http sink wait
+	httpMaxRetryAfter = 5 * time.Minute
+)
+
+// httpSink POSTs log lines in a format to an http address. Lines are sent in batches of at most batchSize lines,
+// or once batchBytes are written in the format, every batch being a whole document of the format.
+// A batch still failing with 429, 5xx or a connection error once retried is dropped and logged unless keepFailed,
+// so the decoder keeps running when the receiver is down, any other failure being returned.
+type httpSink struct {
+	url         string
+	contentType string
+	newWriter   func(w io.Writer) (pxld.Writer, error)
+	batchSize   int
+	batchBytes  int
+	gzip        bool
+	headers     map[string]string
+	bearerToken string
+	basicAuth   []string // user and password, nil when not set
+	retries     int
+	backoff     time.Duration
+	keepFailed  bool   // return the error of a batch failing every retry instead of dropping it
+	secret      []byte // signs every request body with pxld.Sign when not empty
+	cli         *http.Client
+
+	buf     *bytes.Buffer
+	w       pxld.Writer // format writer of the current batch, nil when there is none
+	pending int         // number of lines of the current batch
+}
+
+func newHTTPSink(url, contentType string, newWriter func(w io.Writer) (pxld.Writer, error), batchSize, batchBytes int, gzip bool, headers []string, bearerToken, basicAuth string, retries int, timeout time.Duration) (*httpSink, error) {
+	if !isValidURL(url) {
+		return nil, fmt.Errorf("invalid http url %s", url)
+	}
+
+	hs, err := parseHeaders("http", headers)
+	if err != nil {
+		return nil, err
+	}
+
+	var userPassword []string
+	if basicAuth != "" {
+		userPassword = strings.SplitN(basicAuth, ":", 2)
+		if len(userPassword) != 2 {
+			return nil, fmt.Errorf("invalid http basic auth, it must be user:password")
+		}
+	}
+	if bearerToken != "" && userPassword != nil {
+		return nil, fmt.Errorf("http bearer token and basic auth can not be both used")
+	}
+
+	return &httpSink{
+		url:         url,
+		contentType: contentType,
+		newWriter:   newWriter,
+		batchSize:   batchSize,
+		batchBytes:  batchBytes,
+		gzip:        gzip,
+		headers:     hs,
+		bearerToken: bearerToken,
+		basicAuth:   userPassword,
+		retries:     retries,
+		backoff:     time.Second,
+		cli: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+// Write adds a log line to the current batch, sending the batch once it is full
+func (s *httpSink) Write(l *pxld.LogLine) error {
+	if s.w == nil {
+		s.buf = &bytes.Buffer{}
+
+		w, err := s.newWriter(s.buf)
+		if err != nil {
+			return err
+		}
+
+		s.w = w
+	}
+
+	err := s.w.Write(l)
+	if err != nil {
+		return err
+	}
+	s.pending++
+
+	if (s.batchSize > 0 && s.pending >= s.batchSize) || (s.batchBytes > 0 && s.buf.Len() >= s.batchBytes) {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// Close sends the last batch
+func (s *httpSink) Close() error {
+	return s.flush()
+}
+
+func (s *httpSink) flush() error {
+	if s.w == nil {
+		return nil
+	}
+
+	w, pending := s.w, s.pending
+	s.w, s.pending = nil, 0
+
+	// closing the format writer ends the document, like the closing bracket of a JSON array
+	err := w.Close()
+	if err != nil {
+		return err
+	}
+
+	body := s.buf.Bytes()
+	if s.gzip {
+		gz := &bytes.Buffer{}
+		zw := gzip.NewWriter(gz)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		body = gz.Bytes()
+	}
+
+	err = withRetries(s.retries, s.backoff, func() error {
+		return s.send(body)
+	})
+	if err != nil {
+		if _, ok := err.(httpRejectedError); ok || s.keepFailed {
+			return err
+		}
+
+		log.Errorf("Dropped %d log lines after failing to send them to %s: %v", pending, s.url, err)
+	}
+
+	return nil
+}
+
+// httpRejectedError is a response status code telling the request would fail again, like 400 or 401
+type httpRejectedError struct {
+	error
+}
+
+func (s *httpSink) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{httpRejectedError{err}}
+	}
+
+	req.Header.Set("Content-Type", s.contentType)
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	}
+	if s.basicAuth != nil {
+		req.SetBasicAuth(s.basicAuth[0], s.basicAuth[1])
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if len(s.secret) > 0 {
+		// signed at every attempt, so a retried request is not too old to be verified
+		signature, timestamp := pxld.Sign(s.secret, time.Now(), body)
+		req.Header.Set(pxld.SignatureHeader, signature)
+		req.Header.Set(pxld.TimestampHeader, timestamp)
+	}
+
+	res, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		raw, _ := ioutil.ReadAll(res.Body)
+		err = fmt.Errorf("invalid response status code %d: %s", res.StatusCode, truncate(string(raw), 512))
+		if !isRetryableStatus(res.StatusCode) {
+			return permanentError{httpRejectedError{err}}
+		}
+
+		if wait, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+			return retryAfterError{error: err, wait: wait}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an http date,
+// the wait being at most httpMaxRetryAfter
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = at.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > httpMaxRetryAfter {
+		wait = httpMaxRetryAfter
+	}
+
+	return wait, true
+}
+
+// parseHeaders parses name=value headers, split on the first = only so values can hold any character,
+// kind naming what they are for in errors
+func parseHeaders(kind string, headers []string) (map[string]string, error) {
+	hs := map[string]string{}
+	for _, item := range headers {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid %s header %s, it must be name=value", kind, item)
+		}
+
+		hs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return hs, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+func newJSONArrayWriter(w io.Writer) (pxld.Writer, error) {
+	return &jsonArrayWriter{w: w}, nil
+}
+
+func TestHTTPSink(t *testing.T) {
+	var batches [][]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		require.Equal(t, "proxysql", r.Header.Get("X-Source"))
+		require.Equal(t, "a=1,b=2", r.Header.Get("X-Tags"))
+
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		var batch []map[string]interface{}
+		require.NoError(t, json.NewDecoder(zr).Decode(&batch))
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+
+	s, err := newHTTPSink(srv.URL, "application/json", newJSONArrayWriter, 2, 0, true, []string{"X-Source=proxysql", "X-Tags=a=1,b=2"}, "secret", "", 0, time.Minute)
+	require.NoError(t, err)
+
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// every batch is a whole JSON array
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 2)
+	require.Len(t, batches[1], 1)
+	require.Equal(t, "select * from test", batches[1][0]["query"])
+}
+
+func TestHTTPSinkBatchBytes(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "user", user)
+		require.Equal(t, "pass:word", password)
+
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(raw))
+	}))
+	defer srv.Close()
+
+	s, err := newHTTPSink(srv.URL, "application/x-ndjson", func(w io.Writer) (pxld.Writer, error) {
+		return pxld.NewNDJSONWriter(w), nil
+	}, 0, 1, false, nil, "", "user:pass:word", 0, time.Minute)
+	require.NoError(t, err)
+
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	require.Len(t, bodies, 3)
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	requests := 0
+	status := http.StatusTooManyRequests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", status)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := newHTTPSink(srv.URL, "application/json", newJSONArrayWriter, 1, 0, false, nil, "", "", 1, time.Minute)
+	require.NoError(t, err)
+	s.backoff = time.Millisecond
+
+	// succeeds once retried
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 2, requests)
+
+	// a batch failing every retry is dropped without stopping
+	s.retries = 0
+	requests = 0
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 1, requests)
+
+	// unless kept failing, like in server mode
+	s.keepFailed = true
+	requests = 0
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 1, requests)
+	s.keepFailed = false
+
+	// a rejected batch is an error, not retried
+	s.retries = 1
+	requests = 0
+	status = http.StatusUnauthorized
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 1, requests)
+
+	// nothing listens there
+	srv.Close()
+	require.NoError(t, s.Write(testESLines(t)[0]))
+}
+
+func TestHTTPSinkSignature(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		// the compressed body is signed, as sent
+		_, err := pxld.VerifyRequest(r, []byte("secret"), pxld.DefaultSignatureTolerance, pxld.DefaultMaxSignedBodySize)
+		require.NoError(t, err)
+
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(zr)
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	s, err := newHTTPSink(srv.URL, "application/json", newJSONArrayWriter, 0, 0, true, nil, "", "", 0, time.Minute)
+	require.NoError(t, err)
+	s.secret = []byte("secret")
+
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, 1, requests)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 4, 10, 8, 8, 0, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter("Wed, 10 Apr 2019 08:08:30 GMT", now)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, wait)
+
+	wait, ok = parseRetryAfter("86400", now)
+	require.True(t, ok)
+	require.Equal(t, httpMaxRetryAfter, wait)
+
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+}
+
+func TestHTTPSinkNegative(t *testing.T) {
+	for _, args := range [][]string{
+		{"localhost:8080", "", "", ""},
+		{"http://localhost:8080", "X-Source", "", ""},
+		{"http://localhost:8080", "", "", "user"},
+		{"http://localhost:8080", "", "secret", "user:password"},
+	} {
+		_, err := newHTTPSink(args[0], "application/json", newJSONArrayWriter, 1, 0, false, splitList(args[1]), args[2], args[3], 0, time.Minute)
+		require.Error(t, err, args)
+	}
+}
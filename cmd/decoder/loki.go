@@ -0,0 +1,445 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/snappy"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lokiEncodingProtobuf = "protobuf"
+	lokiEncodingJSON     = "json"
+
+	lokiPushPath = "/loki/api/v1/push"
+
+	// lokiDefaultJob is the default job label, also given to the streams which would have no label otherwise
+	lokiDefaultJob = "proxysql"
+
+	// lokiOrderWindow is how long the last entry pushed to a stream is remembered, Loki accepting entries
+	// out of order within an hour of the newest one of a stream by default
+	lokiOrderWindow = time.Hour
+)
+
+var (
+	// lokiLabelFields are the log line fields usable as Loki stream labels, named after the JSON fields
+	lokiLabelFields = map[string]func(l *pxld.LogLine) string{
+		"username":     func(l *pxld.LogLine) string { return l.Username },
+		"schema":       func(l *pxld.LogLine) string { return l.Schema },
+		"client_addr":  func(l *pxld.LogLine) string { return l.ClientAddr },
+		"server_addr":  func(l *pxld.LogLine) string { return l.ServerAddr },
+		"query_digest": func(l *pxld.LogLine) string { return l.QueryDigest },
+	}
+
+	// lokiPushMu serializes the pushes of every sink, keeping lokiLastPushed in the order entries are pushed
+	lokiPushMu sync.Mutex
+
+	// lokiLastPushed is the last entry pushed to every stream by url, tenant and labels, kept across runs
+	// and concurrent server mode chunks until the stream is not pushed to for lokiOrderWindow
+	lokiLastPushed = map[string]lokiLastEntry{}
+)
+
+// lokiLastEntry is the time of the last entry pushed to a stream and when it was pushed
+type lokiLastEntry struct {
+	at       time.Time
+	pushedAt time.Time
+}
+
+// lokiPushRequest, lokiStream and lokiEntry are the logproto messages of the push API,
+// only declaring what is sent
+type lokiPushRequest struct {
+	Streams []*lokiStream `protobuf:"bytes,1,rep,name=streams,proto3"`
+}
+
+func (m *lokiPushRequest) Reset()         { *m = lokiPushRequest{} }
+func (m *lokiPushRequest) String() string { return proto.CompactTextString(m) }
+func (*lokiPushRequest) ProtoMessage()    {}
+
+type lokiStream struct {
+	Labels  string       `protobuf:"bytes,1,opt,name=labels,proto3"`
+	Entries []*lokiEntry `protobuf:"bytes,2,rep,name=entries,proto3"`
+}
+
+func (m *lokiStream) Reset()         { *m = lokiStream{} }
+func (m *lokiStream) String() string { return proto.CompactTextString(m) }
+func (*lokiStream) ProtoMessage()    {}
+
+type lokiEntry struct {
+	Timestamp *timestamp.Timestamp `protobuf:"bytes,1,opt,name=timestamp,proto3"`
+	Line      string               `protobuf:"bytes,2,opt,name=line,proto3"`
+}
+
+func (m *lokiEntry) Reset()         { *m = lokiEntry{} }
+func (m *lokiEntry) String() string { return proto.CompactTextString(m) }
+func (*lokiEntry) ProtoMessage()    {}
+
+// lokiBatchStream is the pending entries of a stream
+type lokiBatchStream struct {
+	labels  map[string]string
+	entries []lokiBatchEntry
+}
+
+type lokiBatchEntry struct {
+	at   time.Time
+	line string
+}
+
+// lokiSink pushes log lines to Loki as JSON lines, timestamped with the query start time. Lines are batched
+// until batchBytes bytes are pending or the oldest pending line waited batchWait, so Close must be called
+// to push the last batch. Loki wants the entries of a stream in time order, so entries are sorted within
+// a batch and an entry older than the last one pushed to its stream is pushed with the time of that one,
+// its own start time is still in the line. Streams without any label get the job label lokiDefaultJob,
+// as Loki rejects them.
+type lokiSink struct {
+	url        string
+	labels     []string
+	job        string
+	tenant     string
+	encoding   string
+	batchBytes int
+	batchWait  time.Duration
+	retries    int
+	backoff    time.Duration
+	cli        *http.Client
+
+	mu      sync.Mutex
+	streams map[string]*lokiBatchStream
+	size    int
+	timer   *time.Timer
+	waiting sync.WaitGroup // timers of batchWait and their pushes, awaited by Close
+	err     error          // of a push triggered by batchWait, returned by the next call
+}
+
+func newLokiSink(url string, labels []string, job, tenant, encoding string, batchBytes int, batchWait time.Duration, retries int) (*lokiSink, error) {
+	if !isValidURL(url) {
+		return nil, fmt.Errorf("invalid loki url %s", url)
+	}
+
+	for _, label := range labels {
+		if _, ok := lokiLabelFields[label]; !ok {
+			return nil, fmt.Errorf("unknown loki label %s", label)
+		}
+	}
+
+	switch encoding {
+	case lokiEncodingProtobuf, lokiEncodingJSON:
+	default:
+		return nil, fmt.Errorf("unknown loki encoding %s", encoding)
+	}
+
+	if !strings.HasSuffix(url, lokiPushPath) {
+		url = strings.TrimSuffix(url, "/") + lokiPushPath
+	}
+
+	return &lokiSink{
+		url:        url,
+		labels:     labels,
+		job:        job,
+		tenant:     tenant,
+		encoding:   encoding,
+		batchBytes: batchBytes,
+		batchWait:  batchWait,
+		retries:    retries,
+		backoff:    time.Second,
+		cli: &http.Client{
+			Timeout: time.Minute,
+		},
+		streams: map[string]*lokiBatchStream{},
+	}, nil
+}
+
+// Write adds a log line to the stream of its labels, pushing the batch once it is big enough
+func (s *lokiSink) Write(l *pxld.LogLine) error {
+	line, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal to JSON: %v", err)
+	}
+
+	labels := map[string]string{}
+	if s.job != "" {
+		labels["job"] = s.job
+	}
+	for _, label := range s.labels {
+		// Loki drops labels with empty values anyway
+		if v := lokiLabelFields[label](l); v != "" {
+			labels[label] = v
+		}
+	}
+	if len(labels) == 0 {
+		labels["job"] = lokiDefaultJob
+	}
+	key := formatLokiLabels(labels)
+
+	s.mu.Lock()
+	if err := s.takeErr(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &lokiBatchStream{labels: labels}
+		s.streams[key] = stream
+	}
+	stream.entries = append(stream.entries, lokiBatchEntry{at: l.StartAt, line: string(line)})
+	s.size += len(line)
+
+	var batch map[string]*lokiBatchStream
+	if s.size >= s.batchBytes {
+		batch = s.takeBatch()
+	} else if s.timer == nil && s.batchWait > 0 {
+		s.waiting.Add(1)
+		s.timer = time.AfterFunc(s.batchWait, s.pushWaiting)
+	}
+	s.mu.Unlock()
+
+	// pushed without s.mu, so retries do not hold up the batchWait timer
+	return s.push(batch)
+}
+
+// Close pushes the last batch, once the pushes triggered by batchWait are done
+func (s *lokiSink) Close() error {
+	s.mu.Lock()
+	batch := s.takeBatch()
+	s.mu.Unlock()
+
+	err := s.push(batch)
+	s.waiting.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if perr := s.takeErr(); perr != nil {
+		err = perr
+	}
+
+	return err
+}
+
+// takeErr returns then clears the error of the last push triggered by batchWait, s.mu must be held
+func (s *lokiSink) takeErr() error {
+	err := s.err
+	s.err = nil
+
+	return err
+}
+
+// takeBatch returns then clears the pending streams, s.mu must be held
+func (s *lokiSink) takeBatch() map[string]*lokiBatchStream {
+	if s.timer != nil {
+		// a timer already fired is done with once its pushWaiting is
+		if s.timer.Stop() {
+			s.waiting.Done()
+		}
+		s.timer = nil
+	}
+
+	batch := s.streams
+	s.streams, s.size = map[string]*lokiBatchStream{}, 0
+
+	return batch
+}
+
+// pushWaiting pushes the batch once its oldest line waited long enough
+func (s *lokiSink) pushWaiting() {
+	defer s.waiting.Done()
+
+	s.mu.Lock()
+	batch := s.takeBatch()
+	s.mu.Unlock()
+
+	if err := s.push(batch); err != nil {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+	}
+}
+
+// push sends a batch. First attempts are serialized by lokiPushMu, so the entries of a stream are pushed
+// in time order whichever sink or run they come from. The lock is not held while waiting to retry, a retried
+// batch landing after a newer one is left to the out of order window of Loki.
+func (s *lokiSink) push(batch map[string]*lokiBatchStream) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	lokiPushMu.Lock()
+
+	body, contentType, err := s.encode(batch)
+	if err != nil {
+		lokiPushMu.Unlock()
+		return err
+	}
+
+	first := true
+	return withRetries(s.retries, s.backoff, func() error {
+		if first {
+			first = false
+			defer lokiPushMu.Unlock()
+		}
+
+		return s.send(body, contentType)
+	})
+}
+
+// encode sorts the entries of a batch and moves the ones older than the last entry pushed to their stream
+// to its time, then encodes the batch. It must be called with lokiPushMu held.
+func (s *lokiSink) encode(batch map[string]*lokiBatchStream) ([]byte, string, error) {
+	now := time.Now()
+	for key, last := range lokiLastPushed {
+		if now.Sub(last.pushedAt) > lokiOrderWindow {
+			delete(lokiLastPushed, key)
+		}
+	}
+
+	keys := make([]string, 0, len(batch))
+	for key, stream := range batch {
+		keys = append(keys, key)
+
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].at.Before(stream.entries[j].at)
+		})
+
+		lastKey := s.url + "\n" + s.tenant + "\n" + key
+		last := lokiLastPushed[lastKey].at
+		for i := range stream.entries {
+			if stream.entries[i].at.Before(last) {
+				stream.entries[i].at = last
+			}
+			last = stream.entries[i].at
+		}
+		lokiLastPushed[lastKey] = lokiLastEntry{at: last, pushedAt: now}
+	}
+	sort.Strings(keys)
+
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	if s.encoding == lokiEncodingJSON {
+		body, err = encodeLokiJSON(batch, keys)
+		contentType = "application/json"
+	} else {
+		body, err = encodeLokiProtobuf(batch, keys)
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, contentType, nil
+}
+
+func encodeLokiJSON(batch map[string]*lokiBatchStream, keys []string) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{}
+
+	for _, key := range keys {
+		bs := batch[key]
+
+		st := stream{Stream: bs.labels, Values: make([][2]string, 0, len(bs.entries))}
+		for _, e := range bs.entries {
+			st.Values = append(st.Values, [2]string{strconv.FormatInt(e.at.UnixNano(), 10), e.line})
+		}
+
+		req.Streams = append(req.Streams, st)
+	}
+
+	return json.Marshal(req)
+}
+
+func encodeLokiProtobuf(batch map[string]*lokiBatchStream, keys []string) ([]byte, error) {
+	req := &lokiPushRequest{}
+
+	for _, key := range keys {
+		bs := batch[key]
+
+		st := &lokiStream{Labels: key, Entries: make([]*lokiEntry, 0, len(bs.entries))}
+		for _, e := range bs.entries {
+			st.Entries = append(st.Entries, &lokiEntry{
+				Timestamp: &timestamp.Timestamp{Seconds: e.at.Unix(), Nanos: int32(e.at.Nanosecond())},
+				Line:      e.line,
+			})
+		}
+
+		req.Streams = append(req.Streams, st)
+	}
+
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal to protobuf: %v", err)
+	}
+
+	return snappy.Encode(nil, raw), nil
+}
+
+func (s *lokiSink) send(body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenant)
+	}
+
+	res, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		raw, _ := ioutil.ReadAll(res.Body)
+		err = fmt.Errorf("invalid response status code %d: %s", res.StatusCode, truncate(string(raw), 512))
+		if !isRetryableStatus(res.StatusCode) {
+			return permanentError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// formatLokiLabels formats labels like Prometheus does, sorted by name, e.g. {job="proxysql", schema="test"}
+func formatLokiLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &strings.Builder{}
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
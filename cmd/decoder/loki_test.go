@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+// fakeLoki is a stand-in for the push API, keeping the pushed requests decoded from protobuf
+type fakeLoki struct {
+	mu     sync.Mutex
+	pushes []*lokiPushRequest
+	status int
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.status != 0 {
+		http.Error(w, "failed", f.status)
+		return
+	}
+
+	raw, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path != lokiPushPath || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Scope-OrgID") != "team" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	raw, err := snappy.Decode(nil, raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &lokiPushRequest{}
+	if err = proto.Unmarshal(raw, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.pushes = append(f.pushes, req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeLoki) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.pushes)
+}
+
+func TestLokiSink(t *testing.T) {
+	loki := &fakeLoki{}
+	srv := httptest.NewServer(loki)
+	defer srv.Close()
+
+	s, err := newLokiSink(srv.URL, []string{"schema", "server_addr"}, "proxysql", "team", lokiEncodingProtobuf, 1<<20, 0, 0)
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	other := *logs[0]
+	other.Schema = "other"
+
+	// out of order start times
+	late := *logs[1]
+	late.StartAt = logs[0].StartAt.Add(time.Second)
+	require.NoError(t, s.Write(&late))
+	require.NoError(t, s.Write(logs[0]))
+	require.NoError(t, s.Write(&other))
+	require.NoError(t, s.Close())
+
+	require.Len(t, loki.pushes, 1)
+	streams := loki.pushes[0].Streams
+	require.Len(t, streams, 2)
+
+	require.Equal(t, `{job="proxysql", schema="other", server_addr="127.0.0.1:3306"}`, streams[0].Labels)
+	require.Len(t, streams[0].Entries, 1)
+
+	// sorted within the batch
+	require.Equal(t, `{job="proxysql", schema="test", server_addr="127.0.0.1:3306"}`, streams[1].Labels)
+	require.Len(t, streams[1].Entries, 2)
+	require.Equal(t, logs[0].StartAt.Unix(), streams[1].Entries[0].Timestamp.Seconds)
+	require.Equal(t, int32(logs[0].StartAt.Nanosecond()), streams[1].Entries[0].Timestamp.Nanos)
+	require.Equal(t, late.StartAt.Unix(), streams[1].Entries[1].Timestamp.Seconds)
+
+	line := &pxld.LogLine{}
+	require.NoError(t, json.Unmarshal([]byte(streams[1].Entries[0].Line), line))
+	require.Equal(t, logs[0].Query, line.Query)
+
+	// an older line of a later batch is pushed at the last time of its stream
+	require.NoError(t, s.Write(logs[2]))
+	require.NoError(t, s.Close())
+	require.Len(t, loki.pushes, 2)
+	require.Equal(t, late.StartAt.Unix(), loki.pushes[1].Streams[0].Entries[0].Timestamp.Seconds)
+}
+
+func TestLokiSinkAcrossSinks(t *testing.T) {
+	loki := &fakeLoki{}
+	srv := httptest.NewServer(loki)
+	defer srv.Close()
+
+	logs := testESLines(t)
+	late := *logs[1]
+	late.StartAt = logs[0].StartAt.Add(time.Second)
+
+	// like two --repeat runs, the second one pushing an older line to the same stream
+	for _, l := range []*pxld.LogLine{&late, logs[0]} {
+		s, err := newLokiSink(srv.URL, nil, "", "team", lokiEncodingProtobuf, 1<<20, 0, 0)
+		require.NoError(t, err)
+		require.NoError(t, s.Write(l))
+		require.NoError(t, s.Close())
+	}
+
+	require.Len(t, loki.pushes, 2)
+	for _, push := range loki.pushes {
+		// a stream without any label gets the default job
+		require.Equal(t, `{job="proxysql"}`, push.Streams[0].Labels)
+		require.Equal(t, late.StartAt.Unix(), push.Streams[0].Entries[0].Timestamp.Seconds)
+	}
+}
+
+func TestLokiSinkForget(t *testing.T) {
+	loki := &fakeLoki{}
+	srv := httptest.NewServer(loki)
+	defer srv.Close()
+
+	// a stream not pushed to for longer than the window is forgotten by the next push
+	idle := srv.URL + lokiPushPath + "\nteam\n{job=\"idle\"}"
+	lokiPushMu.Lock()
+	lokiLastPushed[idle] = lokiLastEntry{at: time.Now(), pushedAt: time.Now().Add(-2 * lokiOrderWindow)}
+	lokiPushMu.Unlock()
+
+	s, err := newLokiSink(srv.URL, nil, "proxysql", "team", lokiEncodingProtobuf, 1<<20, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.NoError(t, s.Close())
+
+	lokiPushMu.Lock()
+	defer lokiPushMu.Unlock()
+	require.NotContains(t, lokiLastPushed, idle)
+	require.Contains(t, lokiLastPushed, srv.URL+lokiPushPath+"\nteam\n{job=\"proxysql\"}")
+}
+
+func TestLokiSinkRetryUnlocked(t *testing.T) {
+	failing := &fakeLoki{status: http.StatusServiceUnavailable}
+	failingSrv := httptest.NewServer(failing)
+	defer failingSrv.Close()
+
+	loki := &fakeLoki{}
+	srv := httptest.NewServer(loki)
+	defer srv.Close()
+
+	retried, err := newLokiSink(failingSrv.URL, nil, "proxysql", "team", lokiEncodingProtobuf, 1, 0, 1)
+	require.NoError(t, err)
+	retried.backoff = time.Second
+
+	done := make(chan error, 1)
+	go func() {
+		done <- retried.Write(testESLines(t)[0])
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// pushed while the other sink waits to retry
+	s, err := newLokiSink(srv.URL, nil, "proxysql", "team", lokiEncodingProtobuf, 1, 0, 0)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.Less(t, int64(time.Since(start)), int64(retried.backoff/2))
+
+	require.Error(t, <-done)
+}
+
+func TestLokiSinkJSON(t *testing.T) {
+	var body map[string][]struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s, err := newLokiSink(srv.URL+lokiPushPath, []string{"username"}, "", "", lokiEncodingJSON, 1, 0, 0)
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+
+	// pushed as soon as the batch is big enough
+	require.Len(t, body["streams"], 1)
+	require.Equal(t, map[string]string{"username": "didasy"}, body["streams"][0].Stream)
+	require.Len(t, body["streams"][0].Values, 1)
+	require.Equal(t, "1554883680727354000", body["streams"][0].Values[0][0])
+	require.NoError(t, s.Close())
+}
+
+func TestLokiSinkBatchWait(t *testing.T) {
+	loki := &fakeLoki{}
+	srv := httptest.NewServer(loki)
+	defer srv.Close()
+
+	s, err := newLokiSink(srv.URL, nil, "proxysql", "team", lokiEncodingProtobuf, 1<<20, 10*time.Millisecond, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.Eventually(t, func() bool { return loki.count() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, s.Close())
+	require.Equal(t, 1, loki.count())
+
+	// a failed push in the background is returned by the next call
+	loki.mu.Lock()
+	loki.status = http.StatusBadRequest
+	loki.mu.Unlock()
+
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	time.Sleep(50 * time.Millisecond)
+	require.Error(t, s.Close())
+}
+
+func TestLokiSinkNegative(t *testing.T) {
+	_, err := newLokiSink("localhost:3100", nil, "", "", lokiEncodingJSON, 1, 0, 0)
+	require.Error(t, err)
+
+	_, err = newLokiSink("http://localhost:3100", []string{"query"}, "", "", lokiEncodingJSON, 1, 0, 0)
+	require.Error(t, err)
+
+	_, err = newLokiSink("http://localhost:3100", nil, "", "", "xml", 1, 0, 0)
+	require.Error(t, err)
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "failed", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	s, err := newLokiSink(srv.URL, nil, "proxysql", "", lokiEncodingJSON, 1, 0, 1)
+	require.NoError(t, err)
+	s.backoff = time.Millisecond
+
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 2, requests)
+}
+
+func TestFormatLokiLabels(t *testing.T) {
+	require.Equal(t, "{}", formatLokiLabels(nil))
+	require.Equal(t, `{a="x \"y\"", b="z"}`, formatLokiLabels(map[string]string{"b": "z", "a": `x "y"`}))
+}
@@ -5,27 +5,239 @@ import (
 	"github.com/tiket-oss/go-pxld"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	"bytes"
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	// stdinTarget is the target value used to read from stdin
+	stdinTarget = "-"
+)
+
+var (
+	targetFile   = kingpin.Flag("target", "Target file to decode, can be a regular file, named pipe, character device or --target=- for stdin").String()
+	output       = kingpin.Flag("output", "Output of this, can be file path, http address, or omit to stdout unless a service sink like --es-url is used").Default("").String()
+	format       = kingpin.Flag("format", "Output format, json prints indented objects to stdout and writes a JSON array elsewhere, ndjson writes one compact object per line").Default(formatJSON).Enum(formatJSON, formatNDJSON, formatCSV, formatTSV, formatParquet, formatAvro, formatProtobuf, formatSlowLog, formatGeneralLog, formatSQLite, formatMySQL, formatPostgreSQL, formatTemplate)
+	columns      = kingpin.Flag("columns", "Comma separated columns of the csv and tsv formats, named after the JSON fields").Default(strings.Join(pxld.DefaultCSVColumns, ",")).String()
+	rowGroupSize = kingpin.Flag("parquet-row-group-size", "Size of the row groups of the parquet format, buffered in memory until written").Default("128MB").Bytes()
+	rollSize     = kingpin.Flag("roll-size", "Roll to a new output file once it reaches this size, 0 to disable, see --output-append for formats other than parquet").Default("0").Bytes()
+	rollEvery    = kingpin.Flag("roll-interval", "Roll to a new output file once it is open for this long, 0 to disable, see --output-append for formats other than parquet").Default("0").Duration()
+	avroCodec    = kingpin.Flag("avro-codec", "Block compression of the avro format, null, deflate or snappy").Default(pxld.AvroCodecDeflate).Enum(pxld.AvroCodecNull, pxld.AvroCodecDeflate, pxld.AvroCodecSnappy)
+	sqlTable     = kingpin.Flag("sql-table", "Table loaded by the mysql and postgresql formats, optionally prefixed by its database or schema").Default("proxysql_queries").String()
+	sqlBatchSize = kingpin.Flag("sql-batch-size", "Number of rows of every INSERT statement of the mysql format").Default("1000").Int()
+	sqlDDL       = kingpin.Flag("sql-create-table", "Start the mysql and postgresql formats with the CREATE TABLE statement of --sql-table").Bool()
+	tmpl         = kingpin.Flag("template", "Go text/template of every line of the template format, e.g. '{{.StartAt}} {{.Username}} {{.Duration}} {{.Query}}'").String()
+	templateFile = kingpin.Flag("template-file", "File holding the Go text/template of the template format, instead of --template").String()
+	timeFormat   = kingpin.Flag("time-format", "Time format of the csv and tsv formats, a Go time layout or unix, unixmilli, unixmicro").Default(time.RFC3339Nano).String()
+	repeatEvery  = kingpin.Flag("repeat", "Repeat reading from the target file every n seconds, useful for reading logrotated file").Duration()
+	listen       = kingpin.Flag("listen", "Run as a server accepting POSTed raw binary log chunks on this address instead of reading the target file").String()
+	maxBodySize  = kingpin.Flag("max-body-size", "Maximum size of a POSTed log chunk after decompression in server mode").Default("64MB").Bytes()
+	buildIndex   = kingpin.Flag("build-index", "Build the sidecar time index of the target file then exit").Bool()
+	indexEvery   = kingpin.Flag("index-interval", "Number of log lines covered by each sidecar time index entry").Default("1000").Int()
+	from         = kingpin.Flag("from", "Only decode queries started at or after this RFC3339 time, uses the sidecar time index when there is one").String()
+	to           = kingpin.Flag("to", "Only decode queries started before this RFC3339 time, uses the sidecar time index when there is one").String()
+)
+
+var (
+	// file output
+	appendOutput      = kingpin.Flag("output-append", "Append to the --output file instead of overwriting it, implied by the rotation options, --roll-size, --roll-interval and {layout} parts of --output replaced by the query start time").Bool()
+	outputCompression = kingpin.Flag("output-compression", "Compress the rolled --output files, none, gzip or zstd").Default(compressionNone).Enum(compressionNone, compressionGzip, compressionZstd)
+	outputKeep        = kingpin.Flag("output-keep", "Number of rolled --output files kept, the oldest being removed, 0 to keep them all").Int()
+	outputMaxAge      = kingpin.Flag("output-max-age", "Remove the rolled --output files not modified for this long, 0 to keep them all").Duration()
+)
+
+var (
+	// http output
+	httpBatchSize   = kingpin.Flag("http-batch-size", "Maximum number of log lines POSTed at once to an http --output, 0 for no limit").Default("10000").Int()
+	httpBatchBytes  = kingpin.Flag("http-batch-bytes", "POST to an http --output once this many bytes are written in --format, 0 for no limit").Default("5MB").Bytes()
+	httpGzip        = kingpin.Flag("http-gzip", "Compress the bodies POSTed to an http --output with gzip").Bool()
+	httpHeaders     = kingpin.Flag("http-header", "name=value header of the requests to an http --output, can be repeated").Strings()
+	httpBearerToken = kingpin.Flag("http-bearer-token", "Bearer token authenticating the requests to an http --output").String()
+	httpBasicAuth   = kingpin.Flag("http-basic-auth", "user:password authenticating the requests to an http --output").String()
+	httpRetries     = kingpin.Flag("http-retries", "Number of times a request to an http --output failing with 429, 5xx or a connection error is retried, with exponential backoff, before its log lines are dropped").Default("5").Int()
+	httpTimeout     = kingpin.Flag("http-timeout", "Timeout of a request to an http --output").Default("60s").Duration()
+	httpSecret      = kingpin.Flag("http-signing-secret", "Sign the bodies POSTed to an http --output with HMAC-SHA256 using this secret, in the X-Pxld-Signature and X-Pxld-Timestamp headers").Envar("PXLD_HTTP_SIGNING_SECRET").String()
+)
+
+var (
+	// Elasticsearch sink
+	esURL        = kingpin.Flag("es-url", "Elasticsearch or OpenSearch base URL to index log lines into with the _bulk API, credentials can be given in the URL").String()
+	esIndex      = kingpin.Flag("es-index", "Elasticsearch index name, {layout} parts are replaced by the query start time in UTC formatted with the Go time layout").Default("proxysql-{2006.01.02}").String()
+	esBatchSize  = kingpin.Flag("es-batch-size", "Maximum number of log lines of an Elasticsearch _bulk request").Default("500").Int()
+	esBatchBytes = kingpin.Flag("es-batch-bytes", "Maximum size of an Elasticsearch _bulk request body, before it is sent").Default("5MB").Bytes()
+	esRetries    = kingpin.Flag("es-retries", "Number of times a failed Elasticsearch _bulk request or rejected log lines are retried, with exponential backoff").Default("3").Int()
+)
+
+var (
+	// Loki sink
+	lokiURL        = kingpin.Flag("loki-url", "Grafana Loki base URL to push log lines to, credentials can be given in the URL").String()
+	lokiLabels     = kingpin.Flag("loki-labels", "Comma separated log line fields used as Loki stream labels, among username, schema, client_addr, server_addr and query_digest").Default("username,schema,server_addr").String()
+	lokiJob        = kingpin.Flag("loki-job", "Value of the job label of every Loki stream, empty to omit it unless a stream has no other label").Default(lokiDefaultJob).String()
+	lokiTenant     = kingpin.Flag("loki-tenant", "Loki tenant sent as X-Scope-OrgID, empty to omit it").String()
+	lokiEncoding   = kingpin.Flag("loki-encoding", "Encoding of Loki push requests, protobuf (snappy compressed) or json").Default(lokiEncodingProtobuf).Enum(lokiEncodingProtobuf, lokiEncodingJSON)
+	lokiBatchBytes = kingpin.Flag("loki-batch-bytes", "Push to Loki once this many bytes of log lines are pending").Default("1MB").Bytes()
+	lokiBatchWait  = kingpin.Flag("loki-batch-wait", "Push to Loki once the oldest pending log line waited this long").Default("1s").Duration()
+	lokiRetries    = kingpin.Flag("loki-retries", "Number of times a failed Loki push is retried, with exponential backoff").Default("3").Int()
+)
+
 var (
-	targetFile  = kingpin.Flag("target", "Target file to decode").Required().ExistingFile()
-	output      = kingpin.Flag("output", "Output of this, can be file path, http address (60s timeout), or omit to stdout").Default("").String()
-	repeatEvery = kingpin.Flag("repeat", "Repeat reading from the target file every n seconds, useful for reading logrotated file").Duration()
+	// ClickHouse sink
+	clickhouseURL       = kingpin.Flag("clickhouse-url", "ClickHouse HTTP interface URL to insert log lines into, credentials can be given in the URL").String()
+	clickhouseTable     = kingpin.Flag("clickhouse-table", "ClickHouse table to insert into, optionally prefixed by its database").Default("proxysql_queries").String()
+	clickhouseFormat    = kingpin.Flag("clickhouse-format", "ClickHouse insert format, JSONEachRow or RowBinary").Default(clickhouseFormatRowBinary).Enum(clickhouseFormatJSONEachRow, clickhouseFormatRowBinary)
+	clickhouseBatchSize = kingpin.Flag("clickhouse-batch-size", "Number of log lines of a ClickHouse insert").Default("10000").Int()
+	clickhouseRetries   = kingpin.Flag("clickhouse-retries", "Number of times a failed ClickHouse insert is retried, with exponential backoff").Default("3").Int()
+	clickhouseDDL       = kingpin.Flag("clickhouse-ddl", "Print the recommended CREATE TABLE statement of --clickhouse-table then exit").Bool()
+)
+
+var (
+	// Syslog sink
+	syslogAddr       = kingpin.Flag("syslog-addr", "Syslog address to send log lines to, e.g. udp://localhost:514, tcp://localhost:601, tls://localhost:6514 or unix:///dev/log").String()
+	syslogProtocol   = kingpin.Flag("syslog-protocol", "Syslog message format, rfc5424 with the fields as structured data or rfc3164").Default(syslogRFC5424).Enum(syslogRFC5424, syslogRFC3164)
+	syslogFacility   = kingpin.Flag("syslog-facility", "Syslog facility, e.g. user, daemon or local0 to local7").Default("local0").String()
+	syslogSeverity   = kingpin.Flag("syslog-severity", "Syslog severity of queries below every --syslog-severity-by-duration threshold").Default("info").String()
+	syslogSeverityBy = kingpin.Flag("syslog-severity-by-duration", "Comma separated duration=severity thresholds, e.g. 1s=notice,10s=warning gives queries lasting at least 10s the warning severity").String()
+	syslogAppName    = kingpin.Flag("syslog-app-name", "Syslog app name").Default("proxysql").String()
+	syslogHostname   = kingpin.Flag("syslog-hostname", "Syslog hostname, the one of this host by default").String()
+	syslogCA         = kingpin.Flag("syslog-tls-ca", "PEM file of the certificate authorities trusted for a tls syslog address instead of the system ones").String()
+)
+
+var (
+	// OTLP sink
+	otlpURL         = kingpin.Flag("otlp-url", "OTLP/HTTP base URL to export log lines to as log records, e.g. http://localhost:4318").String()
+	otlpEncoding    = kingpin.Flag("otlp-encoding", "Encoding of OTLP export requests, protobuf or json").Default(otlpEncodingProtobuf).Enum(otlpEncodingProtobuf, otlpEncodingJSON)
+	otlpHeaders     = kingpin.Flag("otlp-header", "name=value header of OTLP export requests, e.g. for authentication, can be repeated").Strings()
+	otlpServiceName = kingpin.Flag("otlp-service-name", "service.name resource attribute of the exported log records").Default("proxysql").String()
+	otlpBatchSize   = kingpin.Flag("otlp-batch-size", "Number of log records of an OTLP export request").Default("512").Int()
+	otlpRetries     = kingpin.Flag("otlp-retries", "Number of times a failed OTLP export request is retried, with exponential backoff").Default("3").Int()
+)
+
+var (
+	// StatsD sink
+	statsdAddr       = kingpin.Flag("statsd-addr", "StatsD or DogStatsD host:port to send query count and duration metrics to over UDP, e.g. localhost:8125").String()
+	statsdFlavor     = kingpin.Flag("statsd-flavor", "StatsD protocol flavor, statsd with tags as metric name segments or dogstatsd with tags").Default(statsdFlavorDogStatsD).Enum(statsdFlavorStatsD, statsdFlavorDogStatsD)
+	statsdPrefix     = kingpin.Flag("statsd-prefix", "Prefix of the metric names").Default("proxysql.").String()
+	statsdTags       = kingpin.Flag("statsd-tags", "Comma separated fields tagging the metrics among username, schema, client_addr, server_addr and query_digest").Default("schema,username,server_addr").String()
+	statsdFlushEvery = kingpin.Flag("statsd-flush-interval", "Send the metrics aggregated since the last flush this often").Default("10s").Duration()
+	statsdMaxPacket  = kingpin.Flag("statsd-max-packet", "Maximum size in bytes of a metrics packet").Default("1432").Int()
+)
+
+var (
+	// Prometheus metrics
+	metricsListen      = kingpin.Flag("metrics-listen", "Serve Prometheus metrics of the decoded queries on /metrics of this address, most useful with --repeat, --listen or a streamed target").String()
+	metricsBuckets     = kingpin.Flag("metrics-buckets", "Comma separated upper bounds in seconds of the query duration histogram buckets").Default("0.001,0.005,0.01,0.05,0.1,0.5,1,5,10").String()
+	metricsDigest      = kingpin.Flag("metrics-digest", "Also label metrics by query digest, the digests beyond --metrics-digest-limit being labeled other").Bool()
+	metricsDigestLimit = kingpin.Flag("metrics-digest-limit", "Maximum number of distinct digest labels").Default("100").Int()
+)
+
+var (
+	// stdoutMu keeps lines of concurrent senders from interleaving on stdout
+	stdoutMu sync.Mutex
+
+	// metrics counts the decoded queries when --metrics-listen is set
+	metrics *queryMetrics
+
+	// fromAt and toAt are the parsed --from and --to values, zero when not set
+	fromAt time.Time
+	toAt   time.Time
+
+	// templateSource is the template of the template format, read once from --template or --template-file
+	templateSource string
 )
 
 func main() {
 	kingpin.Parse()
 
+	if *clickhouseDDL {
+		fmt.Print(clickhouseCreateTable(*clickhouseTable))
+		return
+	}
+
+	if *targetFile == "" && *listen == "" {
+		kingpin.Fatalf("either --target or --listen is required")
+	}
+
+	if *metricsListen != "" {
+		var err error
+		metrics, err = newQueryMetrics(*metricsBuckets, *metricsDigest, *metricsDigestLimit)
+		if err != nil {
+			kingpin.Fatalf("invalid metrics options: %v", err)
+		}
+	}
+
+	if *format == formatTemplate {
+		var err error
+		templateSource, err = templateText()
+		if err != nil {
+			kingpin.Fatalf("invalid template options: %v", err)
+		}
+	}
+
+	// fail before touching any output
+	if err := checkOutput(); err != nil {
+		kingpin.Fatalf("invalid output options: %v", err)
+	}
+
 	log.Infof("Starting ProxySQL query log decoder")
 
-	if *repeatEvery > 0 {
+	if metrics != nil {
+		go func() {
+			err := serveMetrics(*metricsListen, metrics)
+			log.Fatalf("Unexpected error while serving metrics on %s: %v", *metricsListen, err)
+		}()
+	}
+
+	if *targetFile == stdinTarget && *repeatEvery > 0 {
+		log.Fatalf("Can not repeat reading from stdin")
+	}
+
+	var err error
+	if *from != "" {
+		fromAt, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			log.Fatalf("Invalid --from time %s: %v", *from, err)
+		}
+	}
+	if *to != "" {
+		toAt, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("Invalid --to time %s: %v", *to, err)
+		}
+	}
+
+	if *buildIndex {
+		idx, err := pxld.BuildIndexFile(*targetFile, *indexEvery)
+		if err != nil {
+			log.Fatalf("Unexpected error while building index of file %s: %v", *targetFile, err)
+		}
+
+		log.Infof("Built index %s with %d entries", pxld.IndexPath(*targetFile), len(idx.Entries))
+	} else if *listen != "" {
+		sink, err := newServerSink()
+		if err != nil {
+			log.Fatalf("Unexpected error while opening output %s: %v", *output, err)
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+		err = serve(*listen, int64(*maxBodySize), sink.send, stop)
+		cerr := sink.Close()
+		if err != nil {
+			log.Fatalf("Unexpected error while serving on %s: %v", *listen, err)
+		}
+		if cerr != nil {
+			log.Fatalf("Unexpected error while closing output %s: %v", *output, cerr)
+		}
+	} else if *repeatEvery > 0 {
 		t := time.Tick(*repeatEvery)
 
 		for {
@@ -41,43 +253,171 @@ func main() {
 }
 
 func do() {
-	logs, err := pxld.DecodeFile(*targetFile)
+	out, err := openSink(*targetFile)
 	if err != nil {
-		log.Fatalf("Unexpected error while decoding file %s: %v", *targetFile, err)
+		log.Fatalf("Unexpected error while opening output %s: %v", *output, err)
 	}
 
-	if *output == "" {
+	write := func(l *pxld.LogLine) {
+		err := out.Write(l)
+		if err != nil {
+			log.Fatalf("Unexpected error while sending file %s to %s: %v", *targetFile, *output, err)
+		}
+	}
+
+	if (*from != "" || *to != "") && isRegularFile(*targetFile) {
+		logs, err := pxld.DecodeRange(*targetFile, fromAt, toAt)
+		if err != nil {
+			log.Fatalf("Unexpected error while decoding file %s: %v", *targetFile, err)
+		}
+
 		for _, l := range logs {
-			fmt.Println(l)
+			write(l)
 		}
 	} else {
-		raw, err := json.Marshal(logs)
+		f, err := openTarget(*targetFile)
 		if err != nil {
-			log.Fatalf("Unexpected error while marshaling  file %s to JSON: %v", *targetFile, err)
+			log.Fatalf("Unexpected error while opening file %s: %v", *targetFile, err)
 		}
+		defer f.Close()
 
-		if isValidURL(*output) {
-			cli := &http.Client{
-				Timeout: time.Minute,
+		// write every line as soon as it is decoded, streams can not seek so the time range is applied here
+		dec := pxld.NewDecoder(f)
+		for {
+			l, err := dec.Decode()
+			if err == io.EOF {
+				break
 			}
-			res, err := cli.Post(*output, "application/json", bytes.NewReader(raw))
 			if err != nil {
-				log.Fatalf("Unexpected error while sending file %s JSON to %s: %v", *targetFile, *output, err)
+				log.Fatalf("Unexpected error while decoding file %s at offset %d: %v", *targetFile, dec.Offset(), err)
 			}
-			if res.StatusCode >= http.StatusBadRequest {
-				err = fmt.Errorf("invalid response status code %d", res.StatusCode)
-				log.Fatalf("Unexpected error while sending file %s JSON to %s: %v", *targetFile, *output, err)
+
+			if l.StartedWithin(fromAt, toAt) {
+				write(l)
 			}
-		} else {
-			err = ioutil.WriteFile(*output, raw, 0644)
+		}
+	}
+
+	err = out.Close()
+	if err != nil {
+		log.Fatalf("Unexpected error while sending file %s to %s: %v", *targetFile, *output, err)
+	}
+}
+
+// serverSink forwards the chunks of server mode. Its service sinks stay open for the lifetime of the server,
+// so the ones batching or aggregating lines over time, like loki and statsd, keep doing it across chunks.
+type serverSink struct {
+	mu       sync.Mutex
+	services multiSink
+}
+
+// flusher is a service sink batching lines without a timer, flushed after every chunk so that a chunk is
+// only answered once its lines are sent
+type flusher interface {
+	flush() error
+}
+
+func newServerSink() (*serverSink, error) {
+	// offsets are relative to every chunk, so only the messages tell apart lines of different chunks
+	services, err := openServiceSinks("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverSink{services: services}, nil
+}
+
+// send writes the decoded lines of a chunk to the service sinks, then to the stream sink opened for the chunk
+func (s *serverSink) send(logs []*pxld.LogLine) error {
+	err := s.sendServices(logs)
+	if err != nil {
+		return err
+	}
+
+	if !useStream() {
+		return nil
+	}
+
+	out, err := openStreamSink("")
+	if err != nil {
+		return err
+	}
+
+	for _, l := range logs {
+		err = out.Write(l)
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+func (s *serverSink) sendServices(logs []*pxld.LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range logs {
+		err := s.services.Write(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sink := range s.services {
+		if f, ok := sink.(flusher); ok {
+			err := f.flush()
 			if err != nil {
-				log.Fatalf("Unexpected error while writing file %s JSON to %s: %v", *targetFile, *output, err)
+				return err
 			}
 		}
 	}
+
+	return nil
+}
+
+// Close closes the service sinks once the server is shut down, sending what they still hold
+func (s *serverSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.services.Close()
 }
 
 func isValidURL(toTest string) bool {
-	_, err := url.ParseRequestURI(toTest)
-	return err == nil
+	u, err := url.ParseRequestURI(toTest)
+	// an absolute file path is a valid request URI too
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// isRegularFile check if the target is a regular file, which is needed to seek using the sidecar time index
+func isRegularFile(target string) bool {
+	if target == stdinTarget {
+		return false
+	}
+
+	fi, err := os.Stat(target)
+
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// openTarget opens the file to decode, it only accepts sources that can be read sequentially
+func openTarget(target string) (io.ReadCloser, error) {
+	if target == stdinTarget {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := fi.Mode()
+	if !mode.IsRegular() && mode&(os.ModeNamedPipe|os.ModeCharDevice) == 0 {
+		return nil, fmt.Errorf("%s is not a regular file, named pipe or character device", target)
+	}
+
+	// opened read only, holding a write end of a named pipe would prevent it from reaching EOF
+	return os.Open(target)
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// metricsOtherDigest is the digest label of the queries of digests beyond the limit
+	metricsOtherDigest = "other"
+)
+
+var (
+	// metricsLabels are the label names of every series, digest being only there when enabled
+	metricsLabels = []string{"schema", "username", "server_addr", "digest"}
+
+	// metricsLabelEscaper escapes label values of the Prometheus text format
+	metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// querySeries is the count and duration histogram of the queries of a label set
+type querySeries struct {
+	labels  []string
+	count   uint64
+	sum     float64
+	buckets []uint64 // not cumulative, the last one counts the queries above every bound
+}
+
+// queryMetrics counts decoded queries and their durations, and serves them in the Prometheus text format.
+// It lives as long as the decoder, sinks opened by every run writing to it.
+type queryMetrics struct {
+	bounds      []float64
+	digests     bool
+	digestLimit int
+
+	mu           sync.Mutex
+	series       map[string]*querySeries
+	knownDigests map[string]bool
+	tracker      *lineTracker
+}
+
+func newQueryMetrics(buckets string, digests bool, digestLimit int) (*queryMetrics, error) {
+	bounds := []float64{}
+	for _, item := range splitList(buckets) {
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics bucket %s: %v", item, err)
+		}
+
+		bounds = append(bounds, b)
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("no metrics bucket")
+	}
+	sort.Float64s(bounds)
+
+	return &queryMetrics{
+		bounds:       bounds,
+		digests:      digests,
+		digestLimit:  digestLimit,
+		series:       map[string]*querySeries{},
+		knownDigests: map[string]bool{},
+		tracker:      newLineTracker(),
+	}, nil
+}
+
+// sink returns a writer counting the lines of a source, lines of an unnamed source are always counted
+func (m *queryMetrics) sink(source string) pxld.Writer {
+	return &metricsSink{metrics: m, source: source}
+}
+
+// observe counts a query unless it was counted already, m.mu must be held
+func (m *queryMetrics) observe(source string, l *pxld.LogLine) {
+	if !m.tracker.isNew(source, l) {
+		return
+	}
+
+	labels := []string{l.Schema, l.Username, l.ServerAddr}
+	if m.digests {
+		digest := l.QueryDigest
+		if !m.knownDigests[digest] {
+			if len(m.knownDigests) < m.digestLimit {
+				m.knownDigests[digest] = true
+			} else {
+				digest = metricsOtherDigest
+			}
+		}
+
+		labels = append(labels, digest)
+	}
+
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &querySeries{labels: labels, buckets: make([]uint64, len(m.bounds)+1)}
+		m.series[key] = s
+	}
+
+	seconds := l.Duration.Seconds()
+	s.count++
+	s.sum += seconds
+	s.buckets[sort.SearchFloat64s(m.bounds, seconds)]++
+}
+
+// ServeHTTP writes every series in the Prometheus text format
+func (m *queryMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("# HELP proxysql_queries_total Number of decoded queries.\n")
+	buf.WriteString("# TYPE proxysql_queries_total counter\n")
+	for _, key := range keys {
+		s := m.series[key]
+		fmt.Fprintf(buf, "proxysql_queries_total{%s} %d\n", m.formatLabels(s.labels, ""), s.count)
+	}
+
+	buf.WriteString("# HELP proxysql_query_duration_seconds Duration of decoded queries.\n")
+	buf.WriteString("# TYPE proxysql_query_duration_seconds histogram\n")
+	for _, key := range keys {
+		s := m.series[key]
+
+		var cumulative uint64
+		for i, b := range m.bounds {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(buf, "proxysql_query_duration_seconds_bucket{%s} %d\n", m.formatLabels(s.labels, strconv.FormatFloat(b, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(buf, "proxysql_query_duration_seconds_bucket{%s} %d\n", m.formatLabels(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(buf, "proxysql_query_duration_seconds_sum{%s} %s\n", m.formatLabels(s.labels, ""), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "proxysql_query_duration_seconds_count{%s} %d\n", m.formatLabels(s.labels, ""), s.count)
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// formatLabels formats the labels of a series, with the le label of a histogram bucket unless empty
+func (m *queryMetrics) formatLabels(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, metricsLabels[i], metricsLabelEscaper.Replace(v)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// serveMetrics serves m on /metrics of addr until it fails
+func serveMetrics(addr string, m *queryMetrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	log.Infof("Serving query metrics on %s/metrics", addr)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// metricsSink counts the lines of a source into queryMetrics
+type metricsSink struct {
+	metrics *queryMetrics
+	source  string
+}
+
+func (s *metricsSink) Write(l *pxld.LogLine) error {
+	s.metrics.mu.Lock()
+	s.metrics.observe(s.source, l)
+	s.metrics.mu.Unlock()
+
+	return nil
+}
+
+// Close does nothing, the metrics outlive the sink
+func (s *metricsSink) Close() error {
+	return nil
+}
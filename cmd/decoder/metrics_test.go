@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, m *queryMetrics) string {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	raw, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	return string(raw)
+}
+
+func TestQueryMetrics(t *testing.T) {
+	m, err := newQueryMetrics("0.5,0.1", false, 0)
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	logs[1].Duration = 100 * time.Millisecond
+	logs[2].Duration = time.Second
+
+	s := m.sink("queries.log")
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	labels := `schema="test",username="didasy",server_addr="127.0.0.1:3306"`
+	require.Equal(t, `# HELP proxysql_queries_total Number of decoded queries.
+# TYPE proxysql_queries_total counter
+proxysql_queries_total{`+labels+`} 3
+# HELP proxysql_query_duration_seconds Duration of decoded queries.
+# TYPE proxysql_query_duration_seconds histogram
+proxysql_query_duration_seconds_bucket{`+labels+`,le="0.1"} 2
+proxysql_query_duration_seconds_bucket{`+labels+`,le="0.5"} 2
+proxysql_query_duration_seconds_bucket{`+labels+`,le="+Inf"} 3
+proxysql_query_duration_seconds_sum{`+labels+`} 1.1
+proxysql_query_duration_seconds_count{`+labels+`} 3
+`, scrape(t, m))
+
+	// decoding the same file again only counts the new lines
+	s = m.sink("queries.log")
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.Contains(t, scrape(t, m), "proxysql_queries_total{"+labels+"} 3\n")
+
+	// a rotated file starts with another line
+	rotated := *logs[0]
+	rotated.RawMessage = []byte("rotated")
+	require.NoError(t, s.Write(&rotated))
+	require.Contains(t, scrape(t, m), "proxysql_queries_total{"+labels+"} 4\n")
+
+	// lines of an unnamed source are always counted
+	s = m.sink("")
+	require.NoError(t, s.Write(logs[0]))
+	require.NoError(t, s.Write(logs[0]))
+	require.Contains(t, scrape(t, m), "proxysql_queries_total{"+labels+"} 6\n")
+}
+
+func TestQueryMetricsDigest(t *testing.T) {
+	m, err := newQueryMetrics("1", true, 1)
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	logs[1].QueryDigest = "0x1"
+	logs[2].Schema = "a\"b"
+
+	s := m.sink("")
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+
+	out := scrape(t, m)
+	require.Contains(t, out, `proxysql_queries_total{schema="a\"b",username="didasy",server_addr="127.0.0.1:3306",digest="0x426F13B3371DDF38"} 1`+"\n")
+	require.Contains(t, out, `proxysql_queries_total{schema="test",username="didasy",server_addr="127.0.0.1:3306",digest="0x426F13B3371DDF38"} 1`+"\n")
+	require.Contains(t, out, `proxysql_queries_total{schema="test",username="didasy",server_addr="127.0.0.1:3306",digest="other"} 1`+"\n")
+	require.Equal(t, 3, strings.Count(out, "proxysql_queries_total{"))
+}
+
+func TestQueryMetricsNegative(t *testing.T) {
+	_, err := newQueryMetrics("", false, 0)
+	require.Error(t, err)
+
+	_, err = newQueryMetrics("1,soon", false, 0)
+	require.Error(t, err)
+}
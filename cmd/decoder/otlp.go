@@ -0,0 +1,291 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpEncodingProtobuf = "protobuf"
+	otlpEncodingJSON     = "json"
+
+	otlpLogsPath = "/v1/logs"
+
+	// otlpScopeName is the instrumentation scope of every log record
+	otlpScopeName = "github.com/tiket-oss/go-pxld"
+
+	// otlpSeverityInfo is the INFO severity number
+	otlpSeverityInfo = 9
+)
+
+// The otlp types are the messages of the OTLP logs export request, only declaring what is sent. Their json tags
+// follow the OTLP/JSON mapping, with lower camel case names and 64 bits integers as strings.
+type otlpExportLogsRequest struct {
+	ResourceLogs []*otlpResourceLogs `protobuf:"bytes,1,rep,name=resource_logs,proto3" json:"resourceLogs"`
+}
+
+func (m *otlpExportLogsRequest) Reset()         { *m = otlpExportLogsRequest{} }
+func (m *otlpExportLogsRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportLogsRequest) ProtoMessage()    {}
+
+type otlpResourceLogs struct {
+	Resource  *otlpResource    `protobuf:"bytes,1,opt,name=resource,proto3" json:"resource"`
+	ScopeLogs []*otlpScopeLogs `protobuf:"bytes,2,rep,name=scope_logs,proto3" json:"scopeLogs"`
+}
+
+func (m *otlpResourceLogs) Reset()         { *m = otlpResourceLogs{} }
+func (m *otlpResourceLogs) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceLogs) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes,proto3" json:"attributes"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpScopeLogs struct {
+	Scope      *otlpScope       `protobuf:"bytes,1,opt,name=scope,proto3" json:"scope"`
+	LogRecords []*otlpLogRecord `protobuf:"bytes,2,rep,name=log_records,proto3" json:"logRecords"`
+}
+
+func (m *otlpScopeLogs) Reset()         { *m = otlpScopeLogs{} }
+func (m *otlpScopeLogs) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeLogs) ProtoMessage()    {}
+
+type otlpScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+}
+
+func (m *otlpScope) Reset()         { *m = otlpScope{} }
+func (m *otlpScope) String() string { return proto.CompactTextString(m) }
+func (*otlpScope) ProtoMessage()    {}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64          `protobuf:"fixed64,1,opt,name=time_unix_nano,proto3" json:"timeUnixNano,string"`
+	SeverityNumber       int32           `protobuf:"varint,2,opt,name=severity_number,proto3" json:"severityNumber"`
+	SeverityText         string          `protobuf:"bytes,3,opt,name=severity_text,proto3" json:"severityText"`
+	Body                 *otlpAnyValue   `protobuf:"bytes,5,opt,name=body,proto3" json:"body"`
+	Attributes           []*otlpKeyValue `protobuf:"bytes,6,rep,name=attributes,proto3" json:"attributes"`
+	ObservedTimeUnixNano uint64          `protobuf:"fixed64,11,opt,name=observed_time_unix_nano,proto3" json:"observedTimeUnixNano,string"`
+}
+
+func (m *otlpLogRecord) Reset()         { *m = otlpLogRecord{} }
+func (m *otlpLogRecord) String() string { return proto.CompactTextString(m) }
+func (*otlpLogRecord) ProtoMessage()    {}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3" json:"key"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value,proto3" json:"value"`
+}
+
+func (m *otlpKeyValue) Reset()         { *m = otlpKeyValue{} }
+func (m *otlpKeyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpKeyValue) ProtoMessage()    {}
+
+// otlpAnyValue is a oneof, its fields are pointers so the one that is set is encoded even when zero
+type otlpAnyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value" json:"stringValue,omitempty"`
+	IntValue    *int64  `protobuf:"varint,3,opt,name=int_value" json:"intValue,omitempty,string"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
+
+func otlpString(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{IntValue: &value}}
+}
+
+// newOTLPLogRecord maps a log line to a log record timestamped with the query start time,
+// with the database semantic convention attributes and the ProxySQL specific ones under proxysql.
+func newOTLPLogRecord(l *pxld.LogLine, observedAt time.Time) *otlpLogRecord {
+	attrs := []*otlpKeyValue{
+		otlpString("db.system", "mysql"),
+		otlpString("db.user", l.Username),
+		otlpString("db.name", l.Schema),
+		otlpString("db.statement", l.Query),
+	}
+
+	if l.ServerAddr != "" {
+		host, port, err := net.SplitHostPort(l.ServerAddr)
+		if err != nil {
+			host = l.ServerAddr
+		}
+
+		attrs = append(attrs, otlpString("net.peer.name", host))
+		if p, err := strconv.ParseInt(port, 10, 64); err == nil {
+			attrs = append(attrs, otlpInt("net.peer.port", p))
+		}
+	}
+
+	attrs = append(attrs,
+		otlpInt("proxysql.thread_id", int64(l.ThreadID)),
+		otlpString("proxysql.client_addr", l.ClientAddr),
+		otlpString("proxysql.query_digest", l.QueryDigest),
+		otlpInt("proxysql.duration_ns", int64(l.Duration)),
+	)
+	if l.HID != math.MaxUint64 {
+		attrs = append(attrs, otlpInt("proxysql.hid", int64(l.HID)))
+	}
+
+	query := l.Query
+
+	return &otlpLogRecord{
+		TimeUnixNano:         uint64(l.StartAt.UnixNano()),
+		ObservedTimeUnixNano: uint64(observedAt.UnixNano()),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 &otlpAnyValue{StringValue: &query},
+		Attributes:           attrs,
+	}
+}
+
+// otlpSink exports log lines to an OTLP/HTTP logs endpoint, like the one of an OpenTelemetry collector.
+// Log records are batched until batchSize are pending, so Close must be called to export the last batch.
+type otlpSink struct {
+	url         string
+	encoding    string
+	headers     map[string]string
+	serviceName string
+	batchSize   int
+	retries     int
+	backoff     time.Duration
+	cli         *http.Client
+
+	pending []*otlpLogRecord
+}
+
+func newOTLPSink(url, encoding string, headers []string, serviceName string, batchSize, retries int) (*otlpSink, error) {
+	if !isValidURL(url) {
+		return nil, fmt.Errorf("invalid otlp url %s", url)
+	}
+
+	switch encoding {
+	case otlpEncodingProtobuf, otlpEncodingJSON:
+	default:
+		return nil, fmt.Errorf("unknown otlp encoding %s", encoding)
+	}
+
+	hs, err := parseHeaders("otlp", headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(url, otlpLogsPath) {
+		url = strings.TrimSuffix(url, "/") + otlpLogsPath
+	}
+
+	return &otlpSink{
+		url:         url,
+		encoding:    encoding,
+		headers:     hs,
+		serviceName: serviceName,
+		batchSize:   batchSize,
+		retries:     retries,
+		backoff:     time.Second,
+		cli: &http.Client{
+			Timeout: time.Minute,
+		},
+	}, nil
+}
+
+// Write adds a log record to the current batch, exporting the batch once it is full
+func (s *otlpSink) Write(l *pxld.LogLine) error {
+	s.pending = append(s.pending, newOTLPLogRecord(l, time.Now()))
+
+	if len(s.pending) >= s.batchSize {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// Close exports the last batch
+func (s *otlpSink) Close() error {
+	return s.flush()
+}
+
+func (s *otlpSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	req := &otlpExportLogsRequest{
+		ResourceLogs: []*otlpResourceLogs{{
+			Resource: &otlpResource{
+				Attributes: []*otlpKeyValue{otlpString("service.name", s.serviceName)},
+			},
+			ScopeLogs: []*otlpScopeLogs{{
+				Scope:      &otlpScope{Name: otlpScopeName},
+				LogRecords: s.pending,
+			}},
+		}},
+	}
+	s.pending = nil
+
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	if s.encoding == otlpEncodingJSON {
+		body, err = json.Marshal(req)
+		contentType = "application/json"
+	} else {
+		body, err = proto.Marshal(req)
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal otlp request: %v", err)
+	}
+
+	return withRetries(s.retries, s.backoff, func() error {
+		return s.send(body, contentType)
+	})
+}
+
+func (s *otlpSink) send(body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		raw, _ := ioutil.ReadAll(res.Body)
+		err = fmt.Errorf("invalid response status code %d: %s", res.StatusCode, truncate(string(raw), 512))
+		if !isRetryableStatus(res.StatusCode) {
+			return permanentError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// otlpAttrs returns the attributes of a log record by key
+func otlpAttrs(r *otlpLogRecord) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	for _, kv := range r.Attributes {
+		if kv.Value.StringValue != nil {
+			attrs[kv.Key] = *kv.Value.StringValue
+		} else if kv.Value.IntValue != nil {
+			attrs[kv.Key] = *kv.Value.IntValue
+		}
+	}
+
+	return attrs
+}
+
+func TestOTLPSink(t *testing.T) {
+	var reqs []*otlpExportLogsRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, otlpLogsPath, r.URL.Path)
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("Api-Key"))
+
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		req := &otlpExportLogsRequest{}
+		require.NoError(t, proto.Unmarshal(raw, req))
+		reqs = append(reqs, req)
+	}))
+	defer srv.Close()
+
+	s, err := newOTLPSink(srv.URL, otlpEncodingProtobuf, []string{"Api-Key=secret"}, "proxysql", 2, 0)
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// a full batch then the rest on Close
+	require.Len(t, reqs, 2)
+	require.Equal(t, "service.name", reqs[0].ResourceLogs[0].Resource.Attributes[0].Key)
+	require.Equal(t, "proxysql", *reqs[0].ResourceLogs[0].Resource.Attributes[0].Value.StringValue)
+	require.Equal(t, otlpScopeName, reqs[0].ResourceLogs[0].ScopeLogs[0].Scope.Name)
+	require.Len(t, reqs[0].ResourceLogs[0].ScopeLogs[0].LogRecords, 2)
+	require.Len(t, reqs[1].ResourceLogs[0].ScopeLogs[0].LogRecords, 1)
+
+	r := reqs[0].ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	require.Equal(t, uint64(logs[0].StartAt.UnixNano()), r.TimeUnixNano)
+	require.NotZero(t, r.ObservedTimeUnixNano)
+	require.Equal(t, int32(otlpSeverityInfo), r.SeverityNumber)
+	require.Equal(t, logs[0].Query, *r.Body.StringValue)
+
+	// zero integers are still there
+	require.Equal(t, map[string]interface{}{
+		"db.system":             "mysql",
+		"db.user":               "didasy",
+		"db.name":               "test",
+		"db.statement":          "select * from test",
+		"net.peer.name":         "127.0.0.1",
+		"net.peer.port":         int64(3306),
+		"proxysql.thread_id":    int64(21),
+		"proxysql.client_addr":  "127.0.0.1:33680",
+		"proxysql.query_digest": "0x426F13B3371DDF38",
+		"proxysql.duration_ns":  int64(0),
+		"proxysql.hid":          int64(1),
+	}, otlpAttrs(r))
+}
+
+func TestOTLPSinkJSON(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer srv.Close()
+
+	s, err := newOTLPSink(srv.URL+otlpLogsPath, otlpEncodingJSON, nil, "proxysql", 10, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.NoError(t, s.Close())
+
+	records := body["resourceLogs"].([]interface{})[0].(map[string]interface{})["scopeLogs"].([]interface{})[0].(map[string]interface{})["logRecords"].([]interface{})
+	require.Len(t, records, 1)
+
+	// 64 bits integers are strings in OTLP/JSON
+	r := records[0].(map[string]interface{})
+	require.Equal(t, "1554883680727354000", r["timeUnixNano"])
+	require.Equal(t, map[string]interface{}{"stringValue": "select * from test"}, r["body"])
+	require.Contains(t, r["attributes"], map[string]interface{}{"key": "proxysql.duration_ns", "value": map[string]interface{}{"intValue": "0"}})
+}
+
+func TestOTLPSinkNegative(t *testing.T) {
+	_, err := newOTLPSink("localhost:4318", otlpEncodingJSON, nil, "proxysql", 1, 0)
+	require.Error(t, err)
+
+	_, err = newOTLPSink("http://localhost:4318", "xml", nil, "proxysql", 1, 0)
+	require.Error(t, err)
+
+	_, err = newOTLPSink("http://localhost:4318", otlpEncodingJSON, []string{"Api-Key"}, "proxysql", 1, 0)
+	require.Error(t, err)
+
+	requests := 0
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "failed", status)
+	}))
+	defer srv.Close()
+
+	s, err := newOTLPSink(srv.URL, otlpEncodingProtobuf, nil, "proxysql", 1, 2)
+	require.NoError(t, err)
+	s.backoff = time.Millisecond
+
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 3, requests)
+
+	// a rejected request is not retried
+	requests = 0
+	status = http.StatusBadRequest
+	require.Error(t, s.Write(testESLines(t)[0]))
+	require.Equal(t, 1, requests)
+}
+
+func TestOTLPWireFormat(t *testing.T) {
+	// key = 1, value = 2 holding int_value = 3, even when zero
+	raw, err := proto.Marshal(otlpInt("a", 0))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x0A, 0x01, 'a', 0x12, 0x02, 0x18, 0x00}, raw)
+
+	// time_unix_nano = 1 is a fixed64
+	raw, err = proto.Marshal(&otlpLogRecord{TimeUnixNano: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x09, 1, 0, 0, 0, 0, 0, 0, 0}, raw)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+	"github.com/tiket-oss/go-pxld/pxldpb"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	formatJSON       = "json"
+	formatNDJSON     = "ndjson"
+	formatCSV        = "csv"
+	formatTSV        = "tsv"
+	formatAvro       = "avro"
+	formatProtobuf   = "protobuf"
+	formatSlowLog    = "slowlog"
+	formatGeneralLog = "generallog"
+	formatMySQL      = "mysql"
+	formatPostgreSQL = "postgresql"
+	formatTemplate   = "template"
+	formatSQLite     = "sqlite"
+)
+
+var (
+	// contentTypes are the content types of the formats when POSTed, application/json by default
+	contentTypes = map[string]string{
+		formatNDJSON:     "application/x-ndjson",
+		formatCSV:        "text/csv",
+		formatTSV:        "text/tab-separated-values",
+		formatAvro:       "avro/binary",
+		formatProtobuf:   "application/x-protobuf; delimited=true",
+		formatSlowLog:    "text/plain",
+		formatGeneralLog: "text/plain",
+		formatMySQL:      "application/sql",
+		formatPostgreSQL: "application/sql",
+		formatTemplate:   "text/plain",
+	}
+)
+
+// streamSink writes log lines in a format to a byte stream destination
+type streamSink struct {
+	pxld.Writer
+	dst io.WriteCloser
+}
+
+// Close flushes the format writer then closes the destination
+func (s *streamSink) Close() error {
+	err := s.Writer.Close()
+	if cerr := s.dst.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// checkOutput checks the output options without touching the output
+func checkOutput() error {
+	_, err := openServiceSinks("")
+	if err != nil {
+		return err
+	}
+
+	if !useStream() {
+		return nil
+	}
+
+	switch *format {
+	case formatParquet:
+		if *listen != "" {
+			return fmt.Errorf("the parquet format can not be appended to in server mode")
+		}
+
+		_, err := newParquetSink(*output, int64(*rowGroupSize), int64(*rollSize), *rollEvery)
+		return err
+	case formatSQLite:
+		return checkSQLiteSink(*output)
+	}
+
+	if isValidURL(*output) {
+		_, err = openHTTPSink()
+		if err != nil {
+			return err
+		}
+	} else if useFileSink() {
+		_, err = openFileSink()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = newFormatWriter(*format, ioutil.Discard, false)
+
+	return err
+}
+
+// useStream reports whether --output and --format are used, stdout being the default
+// only when no service sink like --es-url is configured
+func useStream() bool {
+	return *output != "" || (*esURL == "" && *lokiURL == "" && *clickhouseURL == "" && *syslogAddr == "" && *otlpURL == "" && *statsdAddr == "" && metrics == nil)
+}
+
+// openSink opens the configured outputs, every line written to it must be followed by a Close.
+// The source is the name of what is decoded, used by the sinks needing to know where lines come from.
+func openSink(source string) (pxld.Writer, error) {
+	sinks, err := openServiceSinks(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if useStream() {
+		s, err := openStreamSink(source)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+
+	return sinks, nil
+}
+
+// openServiceSinks opens the sinks sending log lines to services, they only connect once written to
+func openServiceSinks(source string) (multiSink, error) {
+	sinks := multiSink{}
+
+	if *esURL != "" {
+		es, err := newESSink(*esURL, *esIndex, source, *esBatchSize, int(*esBatchBytes), *esRetries)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, es)
+	}
+
+	if *lokiURL != "" {
+		loki, err := newLokiSink(*lokiURL, splitList(*lokiLabels), *lokiJob, *lokiTenant, *lokiEncoding, int(*lokiBatchBytes), *lokiBatchWait, *lokiRetries)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, loki)
+	}
+
+	if *clickhouseURL != "" {
+		ch, err := newClickhouseSink(*clickhouseURL, *clickhouseTable, *clickhouseFormat, *clickhouseBatchSize, *clickhouseRetries)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, ch)
+	}
+
+	if *syslogAddr != "" {
+		sl, err := newSyslogSink(*syslogAddr, *syslogProtocol, *syslogFacility, *syslogSeverity, *syslogSeverityBy, *syslogAppName, *syslogHostname, *syslogCA)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sl)
+	}
+
+	if *otlpURL != "" {
+		otlp, err := newOTLPSink(*otlpURL, *otlpEncoding, *otlpHeaders, *otlpServiceName, *otlpBatchSize, *otlpRetries)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, otlp)
+	}
+
+	if *statsdAddr != "" {
+		sd, err := newStatsdSink(*statsdAddr, *statsdFlavor, *statsdPrefix, splitList(*statsdTags), *statsdFlushEvery, *statsdMaxPacket, source)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sd)
+	}
+
+	if metrics != nil {
+		sinks = append(sinks, metrics.sink(source))
+	}
+
+	return sinks, nil
+}
+
+// openStreamSink opens --output in --format
+func openStreamSink(source string) (pxld.Writer, error) {
+	switch *format {
+	case formatParquet:
+		if *listen != "" {
+			return nil, fmt.Errorf("the parquet format can not be appended to in server mode")
+		}
+
+		return newParquetSink(*output, int64(*rowGroupSize), int64(*rollSize), *rollEvery)
+	case formatSQLite:
+		return newSQLiteSink(*output, source)
+	}
+
+	if isValidURL(*output) {
+		return openHTTPSink()
+	}
+	if useFileSink() {
+		return openFileSink()
+	}
+
+	var (
+		dst      io.WriteCloser
+		toStdout = *output == ""
+	)
+
+	if toStdout {
+		stdoutMu.Lock()
+		dst = stdoutDest{}
+	} else {
+		f, err := os.Create(*output)
+		if err != nil {
+			return nil, err
+		}
+
+		dst = f
+	}
+
+	w, err := newFormatWriter(*format, dst, toStdout)
+	if err != nil {
+		dst.Close()
+		return nil, err
+	}
+
+	return &streamSink{Writer: w, dst: dst}, nil
+}
+
+// openHTTPSink opens the http address of --output, POSTing batches in --format
+func openHTTPSink() (*httpSink, error) {
+	contentType := "application/json"
+	if ct, ok := contentTypes[*format]; ok {
+		contentType = ct
+	}
+
+	newWriter := func(w io.Writer) (pxld.Writer, error) {
+		return newFormatWriter(*format, w, false)
+	}
+
+	s, err := newHTTPSink(*output, contentType, newWriter, *httpBatchSize, int(*httpBatchBytes), *httpGzip, *httpHeaders, *httpBearerToken, *httpBasicAuth, *httpRetries, *httpTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// in server mode the failure is answered to the shipper so it can retry
+	s.keepFailed = *listen != ""
+	s.secret = []byte(*httpSecret)
+
+	return s, nil
+}
+
+// useFileSink reports whether --output is appended to instead of overwritten, which rotating it implies.
+// Server mode always appends, so a chunk does not overwrite the previous ones.
+func useFileSink() bool {
+	return *output != "" && (*appendOutput || *listen != "" || *rollSize > 0 || *rollEvery > 0 || *outputCompression != compressionNone ||
+		*outputKeep > 0 || *outputMaxAge > 0 || timePatternParts.MatchString(*output))
+}
+
+// openFileSink opens the file path of --output, appending to its segments in --format
+func openFileSink() (*fileSink, error) {
+	switch *format {
+	case formatJSON, formatAvro:
+		return nil, fmt.Errorf("the %s format can not be appended to, use ndjson, csv, tsv, protobuf, slowlog, generallog, mysql, postgresql or template", *format)
+	}
+
+	newWriter := func(w io.Writer, appending bool) (pxld.Writer, error) {
+		fw, err := newFormatWriter(*format, w, false)
+		if err != nil {
+			return nil, err
+		}
+
+		// the header row is already there
+		if cw, ok := fw.(*pxld.CSVWriter); ok && appending {
+			cw.NoHeader = true
+		}
+
+		return fw, nil
+	}
+
+	return newFileSink(*output, newWriter, int64(*rollSize), *rollEvery, *outputCompression, *outputKeep, *outputMaxAge)
+}
+
+// newFormatWriter returns the writer of a format, the json format is indented for humans on stdout
+func newFormatWriter(format string, w io.Writer, toStdout bool) (pxld.Writer, error) {
+	switch format {
+	case formatNDJSON:
+		return pxld.NewNDJSONWriter(w), nil
+	case formatCSV, formatTSV:
+		cw, err := pxld.NewCSVWriter(w, splitList(*columns))
+		if err != nil {
+			return nil, err
+		}
+
+		cw.TimeFormat = *timeFormat
+		if format == formatTSV {
+			cw.Comma = '\t'
+		}
+
+		return cw, nil
+	case formatAvro:
+		return pxld.NewAvroWriter(w, *avroCodec)
+	case formatProtobuf:
+		return pxldpb.NewDelimitedWriter(w), nil
+	case formatSlowLog:
+		return pxld.NewSlowLogWriter(w), nil
+	case formatGeneralLog:
+		return pxld.NewGeneralLogWriter(w), nil
+	case formatMySQL, formatPostgreSQL:
+		dialect := pxld.SQLDialectMySQL
+		if format == formatPostgreSQL {
+			dialect = pxld.SQLDialectPostgreSQL
+		}
+
+		sw, err := pxld.NewSQLWriter(w, dialect, *sqlTable)
+		if err != nil {
+			return nil, err
+		}
+
+		sw.BatchSize = *sqlBatchSize
+		sw.CreateTable = *sqlDDL
+
+		return sw, nil
+	case formatTemplate:
+		return pxld.NewTemplateWriter(w, templateSource)
+	default:
+		if toStdout {
+			return &jsonPrettyWriter{w: w}, nil
+		}
+
+		return &jsonArrayWriter{w: w}, nil
+	}
+}
+
+// templateText returns the template of --template or --template-file
+func templateText() (string, error) {
+	if *templateFile == "" {
+		if *tmpl == "" {
+			return "", fmt.Errorf("the template format needs --template or --template-file")
+		}
+
+		return *tmpl, nil
+	}
+
+	if *tmpl != "" {
+		return "", fmt.Errorf("--template and --template-file can not be both used")
+	}
+
+	raw, err := ioutil.ReadFile(*templateFile)
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
+}
+
+// multiSink writes every log line to all its sinks
+type multiSink []pxld.Writer
+
+func (m multiSink) Write(l *pxld.LogLine) error {
+	for _, s := range m {
+		err := s.Write(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes all sinks, returning the first error
+func (m multiSink) Close() error {
+	var err error
+	for _, s := range m {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// checkFilePath checks that the output of a format only writing to files is a file path
+func checkFilePath(format, path string) error {
+	if path == "" || isValidURL(path) {
+		return fmt.Errorf("the %s format needs a file path as output", format)
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// jsonPrettyWriter prints every log line as an indented JSON object
+type jsonPrettyWriter struct {
+	w io.Writer
+}
+
+func (w *jsonPrettyWriter) Write(l *pxld.LogLine) error {
+	_, err := fmt.Fprintln(w.w, l)
+	return err
+}
+
+func (w *jsonPrettyWriter) Close() error {
+	return nil
+}
+
+// jsonArrayWriter writes all log lines as a single JSON array
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (w *jsonArrayWriter) Write(l *pxld.LogLine) error {
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal to JSON: %v", err)
+	}
+
+	sep := []byte{','}
+	if w.count == 0 {
+		sep = []byte{'['}
+	}
+	w.count++
+
+	_, err = w.w.Write(append(sep, raw...))
+
+	return err
+}
+
+func (w *jsonArrayWriter) Close() error {
+	end := "]"
+	if w.count == 0 {
+		end = "[]"
+	}
+
+	_, err := io.WriteString(w.w, end)
+
+	return err
+}
+
+// stdoutDest writes to stdout while holding stdoutMu, which is released on Close
+type stdoutDest struct{}
+
+func (stdoutDest) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdoutDest) Close() error {
+	stdoutMu.Unlock()
+	return nil
+}
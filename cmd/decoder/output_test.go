@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+func TestJSONArrayWriter(t *testing.T) {
+	logs, err := pxld.Decode(bytes.NewReader(append(append([]byte{}, testData...), testData...)))
+	require.NoError(t, err)
+
+	for _, n := range []int{0, 1, 2} {
+		buf := &bytes.Buffer{}
+		w, err := newFormatWriter(formatJSON, buf, false)
+		require.NoError(t, err)
+		for _, l := range logs[:n] {
+			require.NoError(t, w.Write(l))
+		}
+		require.NoError(t, w.Close())
+
+		// the same as marshaling all lines at once
+		raw, err := json.Marshal(logs[:n])
+		require.NoError(t, err)
+		require.Equal(t, string(raw), buf.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	formatParquet = "parquet"
+)
+
+// parquetRow is the Parquet schema of a log line, times are in UNIX microseconds like in the log itself
+type parquetRow struct {
+	ThreadID    int64  `parquet:"name=thread_id, type=INT64, convertedtype=UINT_64"`
+	Username    string `parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Schema      string `parquet:"name=schema, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ClientAddr  string `parquet:"name=client_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	HID         int64  `parquet:"name=hid, type=INT64, convertedtype=UINT_64"`
+	ServerAddr  string `parquet:"name=server_addr, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartAt     int64  `parquet:"name=start_at, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	EndAt       int64  `parquet:"name=end_at, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	DurationNs  int64  `parquet:"name=duration_ns, type=INT64"`
+	QueryDigest string `parquet:"name=query_digest, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Query       string `parquet:"name=query, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func newParquetRow(l *pxld.LogLine) *parquetRow {
+	return &parquetRow{
+		// unsigned values keep their bits, the UINT_64 annotation tells readers how to read them
+		ThreadID:    int64(l.ThreadID),
+		Username:    l.Username,
+		Schema:      l.Schema,
+		ClientAddr:  l.ClientAddr,
+		HID:         int64(l.HID),
+		ServerAddr:  l.ServerAddr,
+		StartAt:     l.StartAt.UnixNano() / int64(time.Microsecond),
+		EndAt:       l.EndAt.UnixNano() / int64(time.Microsecond),
+		DurationNs:  int64(l.Duration),
+		QueryDigest: l.QueryDigest,
+		Query:       l.Query,
+	}
+}
+
+// parquetSink writes log lines to Parquet files. A file is only valid once closed, so rolling to a new file
+// closes the current one. Without rolling, everything goes to path, otherwise every file is named after
+// path with the time it was opened and a sequence number, see rolledPath.
+type parquetSink struct {
+	path         string
+	rowGroupSize int64
+	rollSize     int64
+	rollEvery    time.Duration
+
+	f        *os.File
+	cw       *countingWriter
+	pw       *writer.ParquetWriter
+	openedAt time.Time
+	seq      int
+}
+
+func newParquetSink(path string, rowGroupSize, rollSize int64, rollEvery time.Duration) (*parquetSink, error) {
+	if err := checkFilePath(formatParquet, path); err != nil {
+		return nil, err
+	}
+
+	return &parquetSink{
+		path:         path,
+		rowGroupSize: rowGroupSize,
+		rollSize:     rollSize,
+		rollEvery:    rollEvery,
+	}, nil
+}
+
+// Write writes a log line to the current file, rolling to a new one first when needed
+func (s *parquetSink) Write(l *pxld.LogLine) error {
+	if s.pw != nil && s.shouldRoll() {
+		err := s.closeFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.pw == nil {
+		err := s.openFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.pw.Write(newParquetRow(l))
+}
+
+// Close closes the current file, an empty one is created if nothing was written
+func (s *parquetSink) Close() error {
+	if s.pw == nil && s.seq == 0 {
+		err := s.openFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.pw == nil {
+		return nil
+	}
+
+	return s.closeFile()
+}
+
+func (s *parquetSink) rolling() bool {
+	return s.rollSize > 0 || s.rollEvery > 0
+}
+
+func (s *parquetSink) shouldRoll() bool {
+	// buffered rows are only written when their row group is full, so count them too
+	if s.rollSize > 0 && s.cw.n+s.pw.ObjsSize >= s.rollSize {
+		return true
+	}
+
+	return s.rollEvery > 0 && time.Since(s.openedAt) >= s.rollEvery
+}
+
+func (s *parquetSink) openFile() error {
+	s.openedAt = time.Now()
+	s.seq++
+
+	path := s.path
+	if s.rolling() {
+		path = rolledPath(s.path, s.openedAt, s.seq)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: f}
+	pw, err := writer.NewParquetWriterFromWriter(cw, new(parquetRow), 1)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to create parquet writer: %v", err)
+	}
+	if s.rowGroupSize > 0 {
+		pw.RowGroupSize = s.rowGroupSize
+	}
+
+	s.f, s.cw, s.pw = f, cw, pw
+
+	return nil
+}
+
+func (s *parquetSink) closeFile() error {
+	err := s.pw.WriteStop()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+
+	s.f, s.cw, s.pw = nil, nil, nil
+
+	return err
+}
+
+// rolledPath inserts the UTC time and the sequence number before the extension of path,
+// e.g. queries.parquet becomes queries-20190410T080800Z-0001.parquet
+func rolledPath(path string, t time.Time, seq int) string {
+	ext := filepath.Ext(path)
+
+	return fmt.Sprintf("%s-%s-%04d%s", strings.TrimSuffix(path, ext), t.UTC().Format("20060102T150405Z"), seq, ext)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
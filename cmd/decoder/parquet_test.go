@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func readParquetRows(t *testing.T, path string) []parquetRow {
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	pf, err := buffer.NewBufferFile(raw)
+	require.NoError(t, err)
+
+	pr, err := reader.NewParquetReader(pf, new(parquetRow), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	rows := make([]parquetRow, pr.GetNumRows())
+	require.NoError(t, pr.Read(&rows))
+
+	return rows
+}
+
+func TestParquetSink(t *testing.T) {
+	logs, err := pxld.Decode(bytes.NewReader(append(append([]byte{}, testData...), testData...)))
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.parquet")
+	s, err := newParquetSink(path, 0, 0, 0)
+	require.NoError(t, err)
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	rows := readParquetRows(t, path)
+	require.Len(t, rows, 2)
+	require.Equal(t, parquetRow{
+		ThreadID:    21,
+		Username:    "didasy",
+		Schema:      "test",
+		ClientAddr:  "127.0.0.1:33680",
+		HID:         1,
+		ServerAddr:  "127.0.0.1:3306",
+		StartAt:     1554883680727354,
+		EndAt:       1554883680727354,
+		DurationNs:  0,
+		QueryDigest: "0x426F13B3371DDF38",
+		Query:       "select * from test",
+	}, rows[0])
+}
+
+func TestParquetSinkRoll(t *testing.T) {
+	logs, err := pxld.Decode(bytes.NewReader(testData))
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// every row is bigger than a single byte, so every row rolls to a new file
+	s, err := newParquetSink(filepath.Join(dir, "queries.parquet"), 0, 1, 0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Write(logs[0]))
+	}
+	require.NoError(t, s.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "queries-*-*.parquet"))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, f := range files {
+		require.Len(t, readParquetRows(t, f), 1)
+	}
+}
+
+func TestParquetSinkNegative(t *testing.T) {
+	_, err := newParquetSink("", 0, 0, 0)
+	require.Error(t, err)
+
+	_, err = newParquetSink("http://localhost/logs", 0, 0, 0)
+	require.Error(t, err)
+}
+
+func TestRolledPath(t *testing.T) {
+	tm := time.Date(2019, 4, 10, 8, 8, 0, 0, time.UTC)
+	require.Equal(t, "/tmp/queries-20190410T080800Z-0002.parquet", rolledPath("/tmp/queries.parquet", tm, 2))
+	require.Equal(t, "queries-20190410T080800Z-0001", rolledPath("queries", tm, 1))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"time"
+)
+
+// permanentError marks an error that would happen again if retried
+type permanentError struct {
+	error
+}
+
+// retryAfterError marks an error after which the server asked to wait at least wait before retrying
+type retryAfterError struct {
+	error
+	wait time.Duration
+}
+
+// withRetries calls fn until it succeeds, returns a permanentError or failed retries+1 times,
+// waiting twice as long after every failure starting with backoff, or longer when a retryAfterError asks so
+func withRetries(retries int, backoff time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if perr, ok := err.(permanentError); ok {
+			return perr.error
+		}
+
+		wait := backoff << uint(attempt)
+		if rerr, ok := err.(retryAfterError); ok {
+			if rerr.wait > wait {
+				wait = rerr.wait
+			}
+			err = rerr.error
+		}
+
+		if attempt >= retries {
+			return err
+		}
+
+		log.Warnf("Retrying in %s after error: %v", wait, err)
+		time.Sleep(wait)
+	}
+}
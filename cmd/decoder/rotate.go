@@ -0,0 +1,503 @@
+package main
+
+import (
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	// fileActiveSegments is the number of active segments of a pattern, the one written last and the previous
+	// one, which queries started before a {layout} boundary but ending after it keep writing to
+	fileActiveSegments = 2
+)
+
+var (
+	// compressionExts are appended to the path of a compressed segment
+	compressionExts = map[string]string{
+		compressionGzip: ".gz",
+		compressionZstd: ".zst",
+	}
+
+	// timePatternParts matches the {layout} parts of a templated path
+	timePatternParts = regexp.MustCompile(`\{[^}]*\}`)
+
+	// rolledSuffix matches what rolledPath adds before the extension
+	rolledSuffix = regexp.MustCompile(`-\d{8}T\d{6}Z-\d{4,}$`)
+
+	// layoutRuns matches the runs of digits and of letters of a formatted time
+	layoutRuns = regexp.MustCompile(`[0-9]+|[A-Za-z]+`)
+
+	// filesMu keeps concurrent runs, like server mode chunks, from writing the same files at once
+	filesMu sync.Mutex
+
+	// segmentsOpenedAt is when every active segment was opened, kept across runs for --roll-interval
+	segmentsOpenedAt = map[string]time.Time{}
+
+	// activeSegments are the paths of the active segments of every pattern, the one written last first,
+	// kept across runs so that lines alternating between them do not close and compress them
+	activeSegments = map[string][]string{}
+)
+
+// fileSink appends log lines in a format to files named after a pattern, every {layout} part of it being
+// replaced by the start time of the query, see expandTimePattern. The last fileActiveSegments files written are
+// the active segments, every one is rolled once it reaches rollSize bytes or is open for rollEvery by renaming
+// it like rolledPath does. Every other segment is closed, so it is compressed then pruned by count and age
+// when a segment rolls or becomes active. The active segments stay uncompressed when the sink is closed,
+// so the next run appends to them.
+type fileSink struct {
+	pattern     string
+	newWriter   func(w io.Writer, appending bool) (pxld.Writer, error)
+	rollSize    int64
+	rollEvery   time.Duration
+	compression string
+	keep        int
+	maxAge      time.Duration
+	segments    *segmentMatcher
+
+	locked bool
+	open   map[string]*fileSegment // the active segments opened by this sink, by path
+}
+
+// fileSegment is an open segment
+type fileSegment struct {
+	f  *os.File
+	cw *countingWriter
+	w  pxld.Writer
+}
+
+func newFileSink(pattern string, newWriter func(w io.Writer, appending bool) (pxld.Writer, error), rollSize int64, rollEvery time.Duration, compression string, keep int, maxAge time.Duration) (*fileSink, error) {
+	if pattern == "" || isValidURL(pattern) {
+		return nil, fmt.Errorf("rotating output needs a file path as output")
+	}
+
+	if _, ok := compressionExts[compression]; !ok && compression != compressionNone {
+		return nil, fmt.Errorf("unknown compression %s", compression)
+	}
+
+	segments, err := newSegmentMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{
+		pattern:     pattern,
+		newWriter:   newWriter,
+		rollSize:    rollSize,
+		rollEvery:   rollEvery,
+		compression: compression,
+		keep:        keep,
+		maxAge:      maxAge,
+		segments:    segments,
+		open:        map[string]*fileSegment{},
+	}, nil
+}
+
+// Write appends a log line to the segment of its start time, rolling it first when needed
+func (s *fileSink) Write(l *pxld.LogLine) error {
+	if !s.locked {
+		filesMu.Lock()
+		s.locked = true
+	}
+
+	path := expandTimePattern(s.pattern, l.StartAt)
+	seg := s.open[path]
+	if seg != nil && s.shouldRoll(path, seg) {
+		err := s.closeSegment(path, true)
+		if err != nil {
+			return err
+		}
+		seg = nil
+	}
+
+	activated, err := s.activate(path)
+	if err != nil {
+		return err
+	}
+
+	if seg == nil {
+		seg, err = s.openSegment(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if activated {
+		s.sweep()
+	}
+
+	return seg.w.Write(l)
+}
+
+// Close closes the active segments, keeping them active for the next run
+func (s *fileSink) Close() error {
+	var err error
+	for path := range s.open {
+		if cerr := s.closeSegment(path, false); err == nil {
+			err = cerr
+		}
+	}
+
+	if s.locked {
+		filesMu.Unlock()
+		s.locked = false
+	}
+
+	return err
+}
+
+func (s *fileSink) shouldRoll(path string, seg *fileSegment) bool {
+	if s.rollSize > 0 && seg.cw.n >= s.rollSize {
+		return true
+	}
+
+	return s.rollEvery > 0 && time.Since(segmentsOpenedAt[path]) >= s.rollEvery
+}
+
+// activate makes path the active segment written last, closing the one left for good when there are more than
+// fileActiveSegments, and tells whether path was not active yet
+func (s *fileSink) activate(path string) (bool, error) {
+	active := activeSegments[s.pattern]
+	for i, p := range active {
+		if p == path {
+			copy(active[1:i+1], active[:i])
+			active[0] = path
+			return false, nil
+		}
+	}
+
+	active = append([]string{path}, active...)
+
+	var err error
+	for len(active) > fileActiveSegments {
+		left := active[len(active)-1]
+		active = active[:len(active)-1]
+
+		delete(segmentsOpenedAt, left)
+		if s.open[left] != nil {
+			if cerr := s.closeSegment(left, false); err == nil {
+				err = cerr
+			}
+		}
+	}
+	activeSegments[s.pattern] = active
+
+	return true, err
+}
+
+func (s *fileSink) openSegment(path string) (*fileSegment, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	cw := &countingWriter{w: f, n: info.Size()}
+	w, err := s.newWriter(cw, info.Size() > 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, ok := segmentsOpenedAt[path]; !ok {
+		segmentsOpenedAt[path] = time.Now()
+	}
+
+	seg := &fileSegment{f: f, cw: cw, w: w}
+	s.open[path] = seg
+
+	return seg, nil
+}
+
+// closeSegment closes an open segment, renaming it to a rolled path then sweeping when roll
+func (s *fileSink) closeSegment(path string, roll bool) error {
+	seg := s.open[path]
+	delete(s.open, path)
+
+	err := seg.w.Close()
+	if cerr := seg.f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil || !roll {
+		return err
+	}
+
+	delete(segmentsOpenedAt, path)
+
+	// a free sequence number, rolled and compressed segments included
+	now := time.Now()
+	for seq := 1; ; seq++ {
+		rolled := rolledPath(path, now, seq)
+		if _, err := os.Stat(rolled + compressionExts[s.compression]); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(rolled); !os.IsNotExist(err) {
+			continue
+		}
+
+		err := os.Rename(path, rolled)
+		if err == nil {
+			s.sweep()
+		}
+
+		return err
+	}
+}
+
+// sweep compresses then prunes every closed segment, failures are only logged so writing goes on
+func (s *fileSink) sweep() {
+	segments, err := s.closedSegments()
+	if err != nil {
+		log.Warnf("Failed to list the output segments of %s: %v", s.pattern, err)
+		return
+	}
+
+	if ext, ok := compressionExts[s.compression]; ok {
+		compressed := false
+		for _, path := range segments {
+			if isCompressedSegment(path) {
+				continue
+			}
+
+			err := compressFile(path, ext, s.compression)
+			if err != nil {
+				log.Warnf("Failed to compress output segment %s: %v", path, err)
+				continue
+			}
+			compressed = true
+		}
+
+		if compressed {
+			segments, err = s.closedSegments()
+			if err != nil {
+				log.Warnf("Failed to list the output segments of %s: %v", s.pattern, err)
+				return
+			}
+		}
+	}
+
+	if s.keep <= 0 && s.maxAge <= 0 {
+		return
+	}
+
+	type segment struct {
+		path    string
+		modTime time.Time
+	}
+	infos := []segment{}
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		infos = append(infos, segment{path: path, modTime: info.ModTime()})
+	}
+
+	// newest first
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].modTime.After(infos[j].modTime)
+	})
+
+	for i, seg := range infos {
+		if (s.keep > 0 && i >= s.keep) || (s.maxAge > 0 && time.Since(seg.modTime) > s.maxAge) {
+			err := os.Remove(seg.path)
+			if err != nil {
+				log.Warnf("Failed to remove output segment %s: %v", seg.path, err)
+			}
+		}
+	}
+}
+
+// closedSegments lists the segments of the pattern other than the active ones, rolled and compressed ones included.
+// The glob lists every file which may be one, segmentMatcher tells them apart from other files.
+func (s *fileSink) closedSegments() ([]string, error) {
+	glob := timePatternParts.ReplaceAllString(s.pattern, "*")
+	ext := filepath.Ext(glob)
+	if strings.Contains(ext, "*") {
+		ext = ""
+	}
+
+	matches, err := filepath.Glob(strings.TrimSuffix(glob, ext) + "*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	active := map[string]bool{}
+	for _, path := range activeSegments[s.pattern] {
+		active[path] = true
+	}
+
+	segments := []string{}
+	for _, path := range matches {
+		if !active[path] && s.segments.matches(path) {
+			segments = append(segments, path)
+		}
+	}
+
+	return segments, nil
+}
+
+// segmentMatcher tells whether a path is a segment of a pattern: the pattern with its {layout} parts replaced
+// by a time, then maybe rolled like rolledPath does, then maybe compressed
+type segmentMatcher struct {
+	re      *regexp.Regexp
+	layouts []string // of the groups of re
+}
+
+func newSegmentMatcher(pattern string) (*segmentMatcher, error) {
+	m := &segmentMatcher{}
+
+	// a {layout} part is its formatted shape, e.g. \d{4,}-\d{2,} for 2006-01, checked by parsing once matched
+	pattern = filepath.Clean(pattern)
+	expr := &strings.Builder{}
+	expr.WriteByte('^')
+	last := 0
+	for _, loc := range timePatternParts.FindAllStringIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+
+		layout := pattern[loc[0]+1 : loc[1]-1]
+		shape := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(layout)
+		expr.WriteByte('(')
+		prev := 0
+		for _, run := range layoutRuns.FindAllStringIndex(shape, -1) {
+			expr.WriteString(regexp.QuoteMeta(shape[prev:run[0]]))
+			if c := shape[run[0]]; c >= '0' && c <= '9' {
+				fmt.Fprintf(expr, `\d{%d,}`, run[1]-run[0])
+			} else {
+				expr.WriteString(`[A-Za-z]+`)
+			}
+			prev = run[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(shape[prev:]))
+		expr.WriteByte(')')
+
+		m.layouts = append(m.layouts, layout)
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteByte('$')
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid output pattern %s: %v", pattern, err)
+	}
+	m.re = re
+
+	return m, nil
+}
+
+func (m *segmentMatcher) matches(path string) bool {
+	path = filepath.Clean(path)
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(path, ext) {
+			path = strings.TrimSuffix(path, ext)
+			break
+		}
+	}
+
+	if m.matchesExpanded(path) {
+		return true
+	}
+
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	if loc := rolledSuffix.FindStringIndex(stem); loc != nil {
+		return m.matchesExpanded(stem[:loc[0]] + ext)
+	}
+
+	return false
+}
+
+// matchesExpanded tells whether path is the pattern with its {layout} parts replaced by a time
+func (m *segmentMatcher) matchesExpanded(path string) bool {
+	groups := m.re.FindStringSubmatch(path)
+	if groups == nil {
+		return false
+	}
+
+	for i, layout := range m.layouts {
+		if _, err := time.Parse(layout, groups[i+1]); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isCompressedSegment(path string) bool {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressFile compresses path to path+ext then removes it. The compressed data is appended to path+ext
+// when it exists, as gzip members and zstd frames can be concatenated.
+func compressFile(path, ext, compression string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+ext, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var zw io.WriteCloser
+	if compression == compressionZstd {
+		zw, err = zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+	} else {
+		zw = gzip.NewWriter(dst)
+	}
+
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+func newNDJSONFileWriter(w io.Writer, appending bool) (pxld.Writer, error) {
+	return pxld.NewNDJSONWriter(w), nil
+}
+
+// listDir lists the file names of dir, sorted
+func listDir(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	raw, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+
+	return string(raw)
+}
+
+func TestFileSinkAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.ndjson")
+	logs := testESLines(t)
+
+	for run := 0; run < 2; run++ {
+		s, err := newFileSink(path, newNDJSONFileWriter, 0, 0, compressionNone, 0, 0)
+		require.NoError(t, err)
+		require.NoError(t, s.Write(logs[run]))
+		require.NoError(t, s.Close())
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(raw, []byte("\n")))
+}
+
+func TestFileSinkTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pattern := filepath.Join(dir, "queries-{2006010215}.ndjson")
+	logs := testESLines(t)
+	next := *logs[2]
+	next.StartAt = next.StartAt.Add(time.Hour)
+	last := next
+	last.StartAt = last.StartAt.Add(time.Hour)
+
+	// lines alternating between the segments of two hours keep both active, across runs too
+	for run := 0; run < 2; run++ {
+		s, err := newFileSink(pattern, newNDJSONFileWriter, 0, 0, compressionGzip, 0, 0)
+		require.NoError(t, err)
+		for _, l := range []*pxld.LogLine{logs[0], &next, logs[1], &next} {
+			require.NoError(t, s.Write(l))
+		}
+		require.NoError(t, s.Close())
+	}
+
+	require.Equal(t, []string{"queries-2019041008.ndjson", "queries-2019041009.ndjson"}, listDir(t, dir))
+
+	// the segment of a third hour leaves the first one for good, so it is compressed
+	s, err := newFileSink(pattern, newNDJSONFileWriter, 0, 0, compressionGzip, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(&next))
+	require.NoError(t, s.Write(&last))
+	require.NoError(t, s.Write(&next))
+	require.NoError(t, s.Close())
+
+	require.Equal(t, []string{"queries-2019041008.ndjson.gz", "queries-2019041009.ndjson", "queries-2019041010.ndjson"}, listDir(t, dir))
+
+	// compressed once, as a single gzip member
+	f, err := os.Open(filepath.Join(dir, "queries-2019041008.ndjson.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	zr.Multistream(false)
+	raw, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, 4, bytes.Count(raw, []byte("\n")))
+}
+
+func TestFileSinkRollSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.ndjson")
+	s, err := newFileSink(path, newNDJSONFileWriter, 1, 0, compressionZstd, 0, 0)
+	require.NoError(t, err)
+	for _, l := range testESLines(t) {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// every line but the last is rolled then compressed
+	names := listDir(t, dir)
+	require.Len(t, names, 3)
+	require.Equal(t, "queries.ndjson", names[2])
+	for _, name := range names[:2] {
+		require.Regexp(t, `^queries-\d{8}T\d{6}Z-000\d\.ndjson\.zst$`, name)
+
+		f, err := os.Open(filepath.Join(dir, name))
+		require.NoError(t, err)
+		zr, err := zstd.NewReader(f)
+		require.NoError(t, err)
+		raw, err := ioutil.ReadAll(zr)
+		require.NoError(t, err)
+		require.Equal(t, 1, bytes.Count(raw, []byte("\n")))
+		zr.Close()
+		f.Close()
+	}
+}
+
+func TestFileSinkRollInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.ndjson")
+	logs := testESLines(t)
+
+	s, err := newFileSink(path, newNDJSONFileWriter, 0, time.Hour, compressionNone, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(logs[0]))
+	require.NoError(t, s.Close())
+
+	// the segment opened by a previous run is old enough
+	segmentsOpenedAt[path] = time.Now().Add(-2 * time.Hour)
+
+	s, err = newFileSink(path, newNDJSONFileWriter, 0, time.Hour, compressionNone, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(logs[1]))
+	require.NoError(t, s.Write(logs[2]))
+	require.NoError(t, s.Close())
+
+	names := listDir(t, dir)
+	require.Len(t, names, 2)
+	require.Regexp(t, `^queries-\d{8}T\d{6}Z-0001\.ndjson$`, names[0])
+	require.Equal(t, "queries.ndjson", names[1])
+}
+
+func TestFileSinkPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for i, name := range []string{"queries-20190410T080800Z-0001.ndjson.gz", "queries-20190410T080800Z-0002.ndjson.gz",
+		"queries-20190410T090800Z-0001.ndjson.gz", "other.ndjson", "queries-report.ndjson", "queries.ndjson.bak"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+		require.NoError(t, os.Chtimes(path, old.Add(time.Duration(i)*time.Hour), old.Add(time.Duration(i)*time.Hour)))
+	}
+
+	path := filepath.Join(dir, "queries.ndjson")
+	s, err := newFileSink(path, newNDJSONFileWriter, 0, 0, compressionGzip, 2, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.NoError(t, s.Close())
+
+	// the active segment is not counted, other files are left alone
+	require.Equal(t, []string{"other.ndjson", "queries-20190410T080800Z-0002.ndjson.gz", "queries-20190410T090800Z-0001.ndjson.gz",
+		"queries-report.ndjson", "queries.ndjson", "queries.ndjson.bak"}, listDir(t, dir))
+
+	// like a restarted decoder, which sweeps once it writes
+	delete(activeSegments, path)
+
+	s, err = newFileSink(path, newNDJSONFileWriter, 0, 0, compressionGzip, 0, 24*time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.NoError(t, s.Close())
+
+	require.Equal(t, []string{"other.ndjson", "queries-report.ndjson", "queries.ndjson", "queries.ndjson.bak"}, listDir(t, dir))
+}
+
+func TestSegmentMatcher(t *testing.T) {
+	m, err := newSegmentMatcher("logs/queries-{2006-01-02}.csv")
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		"logs/queries-2019-04-10.csv",
+		"./logs/queries-2019-04-10.csv.gz",
+		"logs/queries-2019-04-10-20190410T080800Z-0012.csv",
+		"logs/queries-2019-04-10-20190410T080800Z-0001.csv.zst",
+	} {
+		require.True(t, m.matches(path), path)
+	}
+
+	for _, path := range []string{
+		"logs/queries-report.csv",
+		"logs/queries-2019-13-10.csv",
+		"logs/queries-2019-04-10.csv.bak",
+		"logs/queries-2019-04-10-copy.csv",
+		"logs/queries_report.csv",
+	} {
+		require.False(t, m.matches(path), path)
+	}
+
+	// without {layout} nor extension, a longer name is another file
+	m, err = newSegmentMatcher("/tmp/out")
+	require.NoError(t, err)
+	require.True(t, m.matches("/tmp/out-20190410T080800Z-0001.gz"))
+	require.False(t, m.matches("/tmp/outbox"))
+}
+
+func TestFileSinkNegative(t *testing.T) {
+	_, err := newFileSink("", newNDJSONFileWriter, 0, 0, compressionNone, 0, 0)
+	require.Error(t, err)
+
+	_, err = newFileSink("http://localhost/logs", newNDJSONFileWriter, 0, 0, compressionNone, 0, 0)
+	require.Error(t, err)
+
+	_, err = newFileSink("queries.ndjson", newNDJSONFileWriter, 0, 0, "lz4", 0, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// serverReadHeaderTimeout, serverReadTimeout and serverWriteTimeout bound how long a shipper can hold
+	// a connection, the write timeout leaving time to forward a chunk with retries
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 5 * time.Minute
+	serverWriteTimeout      = 10 * time.Minute
+)
+
+var (
+	// errBodyTooLarge is returned by limitedReader past its limit
+	errBodyTooLarge = errors.New("request body too large")
+)
+
+// ingestHandler accepts raw ProxySQL binary log chunks and forwards the decoded lines to sendFn
+type ingestHandler struct {
+	maxBodySize int64
+	sendFn      func(logs []*pxld.LogLine) error
+}
+
+// serve runs the ingestion server on addr until it fails, or until stop receives a signal and the chunks
+// being forwarded are answered
+func serve(addr string, maxBodySize int64, sendFn func(logs []*pxld.LogLine) error, stop <-chan os.Signal) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", &ingestHandler{
+		maxBodySize: maxBodySize,
+		sendFn:      sendFn,
+	})
+
+	log.Infof("Listening for ProxySQL query log chunks on %s", addr)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Infof("Shutting down on %v", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), serverWriteTimeout)
+		defer cancel()
+
+		return srv.Shutdown(ctx)
+	}
+}
+
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+
+		body = gz
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// limit after decompression so a small gzip bomb can not exhaust memory
+	limited := &limitedReader{r: body, n: h.maxBodySize}
+
+	// a chunk is all or nothing, a truncated line rejects the whole chunk
+	logs, err := pxld.Decode(limited)
+	if limited.exceeded {
+		http.Error(w, fmt.Sprintf("log chunk is larger than %d bytes", h.maxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode log chunk: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = h.sendFn(logs)
+	if err != nil {
+		log.Errorf("Unexpected error while forwarding %d lines from %s: %v", len(logs), r.RemoteAddr, err)
+		http.Error(w, "failed to forward decoded lines", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// limitedReader reads at most n bytes from r then fails, telling the limit was exceeded
+// rather than ending the body like io.LimitReader
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errBodyTooLarge
+	}
+
+	// read a byte past the limit to tell a body of exactly n bytes from a larger one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.exceeded = true
+		return int(l.n), errBodyTooLarge
+	}
+	l.n -= int64(n)
+
+	return n, err
+}
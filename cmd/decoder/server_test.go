@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+var testData = []byte{
+	0x5C, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x15, 0x06, 0x64,
+	0x69, 0x64, 0x61, 0x73,
+	0x79, 0x04, 0x74, 0x65,
+	0x73, 0x74, 0x0F, 0x31,
+	0x32, 0x37, 0x2E, 0x30,
+	0x2E, 0x30, 0x2E, 0x31,
+	0x3A, 0x33, 0x33, 0x36,
+	0x38, 0x30, 0x01, 0x0E,
+	0x31, 0x32, 0x37, 0x2E,
+	0x30, 0x2E, 0x30, 0x2E,
+	0x31, 0x3A, 0x33, 0x33,
+	0x30, 0x36, 0xFE, 0x3A,
+	0xF1, 0x74, 0x91, 0x28,
+	0x86, 0x05, 0x00, 0xFE,
+	0x3A, 0xF1, 0x74, 0x91,
+	0x28, 0x86, 0x05, 0x00,
+	0xFE, 0x42, 0x6F, 0x13,
+	0xB3, 0x37, 0x1D, 0xDF,
+	0x38, 0x12, 0x73, 0x65,
+	0x6C, 0x65, 0x63, 0x74,
+	0x20, 0x2A, 0x20, 0x66,
+	0x72, 0x6F, 0x6D, 0x20,
+	0x74, 0x65, 0x73, 0x74,
+}
+
+func newTestIngestHandler(sent *[]*pxld.LogLine, sendErr error) *ingestHandler {
+	return &ingestHandler{
+		maxBodySize: 1024,
+		sendFn: func(logs []*pxld.LogLine) error {
+			*sent = append(*sent, logs...)
+			return sendErr
+		},
+	}
+}
+
+func TestIngestHandler(t *testing.T) {
+	var sent []*pxld.LogLine
+	h := newTestIngestHandler(&sent, nil)
+
+	body := append(append([]byte{}, testData...), testData...)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Len(t, sent, 2)
+	require.Equal(t, "select * from test", sent[0].Query)
+}
+
+func TestIngestHandlerGzip(t *testing.T) {
+	var sent []*pxld.LogLine
+	h := newTestIngestHandler(&sent, nil)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write(testData)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/", buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Len(t, sent, 1)
+}
+
+func TestIngestHandlerNegative(t *testing.T) {
+	var sent []*pxld.LogLine
+	h := newTestIngestHandler(&sent, nil)
+
+	// wrong method
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// truncated chunk
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testData[:50])))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// broken gzip
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testData))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// too large
+	h.maxBodySize = 10
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testData)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Empty(t, sent)
+
+	// exactly at the limit
+	h.maxBodySize = int64(len(testData))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testData)))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	sent = nil
+
+	// a header claiming a huge message is not trusted, the body being truncated or too large
+	h.maxBodySize = 1024
+	for _, c := range []struct {
+		length uint64
+		rest   int
+		code   int
+	}{
+		{1 << 35, 8, http.StatusBadRequest},
+		{1 << 62, 8, http.StatusBadRequest},
+		{1 << 35, 2048, http.StatusRequestEntityTooLarge},
+	} {
+		body := make([]byte, 8+c.rest)
+		binary.LittleEndian.PutUint64(body, c.length)
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, c.code, rec.Code, c.length)
+	}
+	require.Empty(t, sent)
+
+	// forwarding failure
+	h = newTestIngestHandler(&sent, errors.New("unreachable"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testData)))
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestServerSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// no stream sink next to the statsd one
+	addr := *statsdAddr
+	*statsdAddr = pc.LocalAddr().String()
+	defer func() { *statsdAddr = addr }()
+
+	sd, err := newStatsdSink(*statsdAddr, statsdFlavorDogStatsD, "", nil, 0, 1432, "")
+	require.NoError(t, err)
+	s := &serverSink{services: multiSink{sd}}
+
+	logs := testESLines(t)
+	require.NoError(t, s.send(logs[:1]))
+	require.NoError(t, s.send(logs[1:]))
+	require.Empty(t, readPackets(t, pc))
+
+	// the chunks are aggregated together until the sink is closed
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{"queries:3|c\nquery.duration:0:0:0|ms"}, readPackets(t, pc))
+}
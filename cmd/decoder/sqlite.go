@@ -0,0 +1,184 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"math"
+
+	_ "github.com/mattn/go-sqlite3" // for the sqlite3 driver
+)
+
+const (
+	// sqliteTimeLayout is understood by the SQLite date and time functions
+	sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+	// sqliteCommitEvery is the number of rows after which the current transaction is committed
+	sqliteCommitEvery = 10000
+)
+
+var (
+	// sqliteSchema creates the queries table and its indexes unless they exist. A log line is only inserted
+	// once, told apart by the SHA-1 of its raw record, so decoding a file again only appends the new lines
+	// whatever its name and offsets, like stdin or a file truncated by copytruncate.
+	sqliteSchema = []string{
+		`CREATE TABLE IF NOT EXISTS queries (
+    id INTEGER PRIMARY KEY,
+    source TEXT,
+    source_offset INTEGER NOT NULL,
+    thread_id INTEGER NOT NULL,
+    username TEXT NOT NULL,
+    schema TEXT NOT NULL,
+    client_addr TEXT NOT NULL,
+    hid INTEGER,
+    server_addr TEXT,
+    start_at TEXT NOT NULL,
+    end_at TEXT NOT NULL,
+    duration_ns INTEGER NOT NULL,
+    query_digest TEXT NOT NULL,
+    query TEXT NOT NULL,
+    record_hash BLOB NOT NULL UNIQUE
+)`,
+		`CREATE INDEX IF NOT EXISTS queries_start_at ON queries (start_at)`,
+		`CREATE INDEX IF NOT EXISTS queries_query_digest ON queries (query_digest)`,
+		`CREATE INDEX IF NOT EXISTS queries_username ON queries (username)`,
+	}
+
+	sqliteInsert = `INSERT OR IGNORE INTO queries (source, source_offset, thread_id, username, schema, client_addr, hid,
+    server_addr, start_at, end_at, duration_ns, query_digest, query, record_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+)
+
+// sqliteSink writes log lines to the queries table of a SQLite database file, creating both when needed.
+// Lines are inserted in transactions of sqliteCommitEvery lines, so Close must be called to commit the last one.
+// The source and offset of every line are kept, the source being NULL when unnamed, like server mode chunks.
+type sqliteSink struct {
+	source string
+
+	db   *sql.DB
+	tx   *sql.Tx
+	stmt *sql.Stmt
+	rows int
+}
+
+// checkSQLiteSink checks the path of a database without touching it
+func checkSQLiteSink(path string) error {
+	return checkFilePath(formatSQLite, path)
+}
+
+func newSQLiteSink(path, source string) (*sqliteSink, error) {
+	if err := checkSQLiteSink(path); err != nil {
+		return nil, err
+	}
+
+	// concurrent sinks of server mode wait for the lock of each other instead of failing with busy
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=60000")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range sqliteSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create sqlite schema: %v", err)
+		}
+	}
+
+	return &sqliteSink{source: source, db: db}, nil
+}
+
+// Write inserts a log line in the current transaction, committing it once big enough
+func (s *sqliteSink) Write(l *pxld.LogLine) error {
+	if s.tx == nil {
+		err := s.begin()
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		source interface{}
+		hid    interface{}
+	)
+	if s.source != "" {
+		source = s.source
+	}
+	// SQLite integers are signed, the HID without a server does not fit
+	if l.HID != math.MaxUint64 {
+		hid = int64(l.HID)
+	}
+
+	hash := sha1.Sum(l.RawMessage)
+
+	_, err := s.stmt.Exec(
+		source,
+		l.Offset,
+		int64(l.ThreadID),
+		l.Username,
+		l.Schema,
+		l.ClientAddr,
+		hid,
+		l.ServerAddr,
+		l.StartAt.UTC().Format(sqliteTimeLayout),
+		l.EndAt.UTC().Format(sqliteTimeLayout),
+		int64(l.Duration),
+		l.QueryDigest,
+		l.Query,
+		hash[:],
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into sqlite: %v", err)
+	}
+
+	s.rows++
+	if s.rows >= sqliteCommitEvery {
+		return s.commit()
+	}
+
+	return nil
+}
+
+// Close commits the current transaction then closes the database
+func (s *sqliteSink) Close() error {
+	var err error
+	if s.tx != nil {
+		err = s.commit()
+	}
+
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (s *sqliteSink) begin() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(sqliteInsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	s.tx, s.stmt = tx, stmt
+
+	return nil
+}
+
+func (s *sqliteSink) commit() error {
+	s.stmt.Close()
+	err := s.tx.Commit()
+
+	s.tx, s.stmt, s.rows = nil, nil, 0
+
+	return err
+}
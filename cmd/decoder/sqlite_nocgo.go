@@ -0,0 +1,24 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+
+	"fmt"
+)
+
+// sqliteSink is not available without cgo, which the sqlite3 driver needs
+type sqliteSink struct {
+	pxld.Writer
+}
+
+// checkSQLiteSink fails as the decoder was built without cgo
+func checkSQLiteSink(path string) error {
+	return fmt.Errorf("the %s format needs the decoder built with cgo, i.e. CGO_ENABLED=1 and a C compiler", formatSQLite)
+}
+
+func newSQLiteSink(path, source string) (*sqliteSink, error) {
+	return nil, checkSQLiteSink(path)
+}
@@ -0,0 +1,98 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-sqlite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.db")
+
+	// distinct records, as testESLines repeats the same one
+	logs := testESLines(t)
+	for i, l := range logs {
+		l.RawMessage = append(append([]byte{}, l.RawMessage...), byte(i))
+	}
+
+	write := func(source string, n int) {
+		s, err := newSQLiteSink(path, source)
+		require.NoError(t, err)
+		for _, l := range logs[:n] {
+			require.NoError(t, s.Write(l))
+		}
+		require.NoError(t, s.Close())
+	}
+
+	// decoding the same file again only appends the new lines
+	write("queries.log", 2)
+	write("queries.log", 3)
+
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	count := func() int {
+		var n int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM queries").Scan(&n))
+		return n
+	}
+	require.Equal(t, 3, count())
+
+	var (
+		username, startAt, serverAddr string
+		hid                           sql.NullInt64
+		duration                      int64
+	)
+	require.NoError(t, db.QueryRow("SELECT username, start_at, hid, server_addr, duration_ns FROM queries WHERE source_offset = 100").
+		Scan(&username, &startAt, &hid, &serverAddr, &duration))
+	require.Equal(t, "didasy", username)
+	require.Equal(t, "2019-04-10 08:08:00.727354", startAt)
+	require.Equal(t, sql.NullInt64{Int64: 1, Valid: true}, hid)
+	require.Equal(t, "127.0.0.1:3306", serverAddr)
+
+	// the times work with the date functions
+	var day string
+	require.NoError(t, db.QueryRow("SELECT DISTINCT date(start_at) FROM queries").Scan(&day))
+	require.Equal(t, "2019-04-10", day)
+
+	// lines already inserted are not inserted again whatever their source, like a server mode chunk sent again
+	write("", 3)
+	write("-", 3)
+	require.Equal(t, 3, count())
+
+	// a new line at the offset of an inserted one is inserted, like after a copytruncate or from stdin
+	truncated := *logs[0]
+	truncated.RawMessage = []byte("truncated")
+	s, err := newSQLiteSink(path, "queries.log")
+	require.NoError(t, err)
+	require.NoError(t, s.Write(&truncated))
+	require.NoError(t, s.Close())
+	require.Equal(t, 4, count())
+
+	var indexes int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'queries' AND name LIKE 'queries_%'").Scan(&indexes))
+	require.Equal(t, 3, indexes)
+}
+
+func TestSQLiteSinkNegative(t *testing.T) {
+	_, err := newSQLiteSink("", "")
+	require.Error(t, err)
+
+	_, err = newSQLiteSink("http://localhost/queries.db", "")
+	require.Error(t, err)
+
+	_, err = newSQLiteSink("/nonexistent/queries.db", "")
+	require.Error(t, err)
+}
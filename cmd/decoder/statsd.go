@@ -0,0 +1,296 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdFlavorStatsD    = "statsd"
+	statsdFlavorDogStatsD = "dogstatsd"
+
+	// statsdMaxTimings is the number of durations kept by a series between flushes,
+	// a sample of them being sent with its rate beyond that
+	statsdMaxTimings = 1000
+)
+
+var (
+	// statsdTagFields are the log line fields usable as tags
+	statsdTagFields = map[string]func(l *pxld.LogLine) string{
+		"username":     func(l *pxld.LogLine) string { return l.Username },
+		"schema":       func(l *pxld.LogLine) string { return l.Schema },
+		"client_addr":  func(l *pxld.LogLine) string { return l.ClientAddr },
+		"server_addr":  func(l *pxld.LogLine) string { return l.ServerAddr },
+		"query_digest": func(l *pxld.LogLine) string { return l.QueryDigest },
+	}
+
+	// statsdTagEscaper replaces the characters separating DogStatsD tags and fields
+	statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+	// statsdTracker keeps the lines sent as metrics by every run, so decoding a file again does not count them twice
+	statsdTracker = newLineTracker()
+)
+
+// statsdSeries is the query count and durations in milliseconds of a tag set since the last flush.
+// The durations are a uniform sample of at most maxTimings of them, kept by reservoir sampling.
+type statsdSeries struct {
+	tags      []string
+	count     int64
+	durations []float64
+}
+
+// add counts a query, keeping its duration d if the sample has room or in place of a random one
+// with a probability keeping the sample uniform
+func (series *statsdSeries) add(d float64, maxTimings int) {
+	series.count++
+
+	if len(series.durations) < maxTimings {
+		series.durations = append(series.durations, d)
+		return
+	}
+
+	if i := rand.Int63n(series.count); i < int64(maxTimings) {
+		series.durations[i] = d
+	}
+}
+
+// statsdSink sends a count and a timing metric of every query to a StatsD or DogStatsD server over UDP.
+// Queries are aggregated by tag set then flushed every flushEvery, so Close must be called to flush the rest.
+// DogStatsD gets the tags as tags, plain StatsD as metric name segments in tag order.
+type statsdSink struct {
+	addr       string
+	flavor     string
+	prefix     string
+	tags       []string
+	flushEvery time.Duration
+	maxPacket  int
+	maxTimings int
+	source     string
+	tracker    *lineTracker
+
+	mu     sync.Mutex
+	conn   net.Conn
+	series map[string]*statsdSeries
+	timer  *time.Timer
+}
+
+func newStatsdSink(addr, flavor, prefix string, tags []string, flushEvery time.Duration, maxPacket int, source string) (*statsdSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid statsd address %s: %v", addr, err)
+	}
+
+	switch flavor {
+	case statsdFlavorStatsD, statsdFlavorDogStatsD:
+	default:
+		return nil, fmt.Errorf("unknown statsd flavor %s", flavor)
+	}
+
+	for _, tag := range tags {
+		if _, ok := statsdTagFields[tag]; !ok {
+			return nil, fmt.Errorf("unknown statsd tag %s", tag)
+		}
+	}
+
+	if maxPacket < 64 {
+		return nil, fmt.Errorf("statsd packet size %d is too small", maxPacket)
+	}
+
+	return &statsdSink{
+		addr:       addr,
+		flavor:     flavor,
+		prefix:     prefix,
+		tags:       tags,
+		flushEvery: flushEvery,
+		maxPacket:  maxPacket,
+		maxTimings: statsdMaxTimings,
+		source:     source,
+		tracker:    statsdTracker,
+		series:     map[string]*statsdSeries{},
+	}, nil
+}
+
+// Write aggregates a query, unless it was sent already by a previous run
+func (s *statsdSink) Write(l *pxld.LogLine) error {
+	if !s.tracker.isNew(s.source, l) {
+		return nil
+	}
+
+	tags := make([]string, len(s.tags))
+	for i, tag := range s.tags {
+		tags[i] = statsdTagFields[tag](l)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.Join(tags, "\xff")
+	series, ok := s.series[key]
+	if !ok {
+		series = &statsdSeries{tags: tags}
+		s.series[key] = series
+	}
+
+	series.add(float64(l.Duration)/float64(time.Millisecond), s.maxTimings)
+
+	if s.timer == nil && s.flushEvery > 0 {
+		s.timer = time.AfterFunc(s.flushEvery, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.timer = nil
+			s.flush()
+		})
+	}
+
+	return nil
+}
+
+// Close flushes the aggregated queries
+func (s *statsdSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// flush sends the aggregated queries, s.mu must be held. Metrics are best effort like UDP,
+// so failing to send them is only logged.
+func (s *statsdSink) flush() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if len(s.series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(s.series))
+	for key := range s.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, s.format(s.series[key])...)
+	}
+	s.series = map[string]*statsdSeries{}
+
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.addr)
+		if err != nil {
+			log.Warnf("Failed to send metrics to statsd %s: %v", s.addr, err)
+			return
+		}
+
+		s.conn = conn
+	}
+
+	for _, packet := range s.pack(lines) {
+		if _, err := s.conn.Write(packet); err != nil {
+			log.Warnf("Failed to send metrics to statsd %s: %v", s.addr, err)
+			return
+		}
+	}
+}
+
+// format returns the metric lines of a series, the timings being packed in as few lines as fit in a packet
+// for DogStatsD and one line each for plain StatsD. Sampled timings have the sample rate, e.g. |@0.5.
+func (s *statsdSink) format(series *statsdSeries) []string {
+	var name, suffix string
+	if s.flavor == statsdFlavorDogStatsD {
+		tags := []string{}
+		for i, tag := range s.tags {
+			if v := series.tags[i]; v != "" {
+				tags = append(tags, tag+":"+statsdTagEscaper.Replace(v))
+			}
+		}
+		if len(tags) > 0 {
+			suffix = "|#" + strings.Join(tags, ",")
+		}
+	} else {
+		for _, v := range series.tags {
+			name += "." + statsdNameSegment(v)
+		}
+	}
+
+	count := s.prefix + "queries" + name
+	timing := s.prefix + "query.duration" + name
+
+	lines := []string{fmt.Sprintf("%s:%d|c%s", count, series.count, suffix)}
+
+	timingSuffix := "|ms"
+	if n := int64(len(series.durations)); n < series.count {
+		timingSuffix += "|@" + strconv.FormatFloat(float64(n)/float64(series.count), 'g', 6, 64)
+	}
+	timingSuffix += suffix
+
+	line := timing
+	for _, d := range series.durations {
+		value := ":" + strconv.FormatFloat(d, 'f', -1, 64)
+
+		packed := s.flavor == statsdFlavorDogStatsD && len(line)+len(value)+len(timingSuffix) <= s.maxPacket
+		if line != timing && !packed {
+			lines = append(lines, line+timingSuffix)
+			line = timing
+		}
+		line += value
+	}
+
+	return append(lines, line+timingSuffix)
+}
+
+// pack joins metric lines by newlines into packets of at most maxPacket bytes, a longer line having its own packet
+func (s *statsdSink) pack(lines []string) [][]byte {
+	packets := [][]byte{}
+
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > s.maxPacket {
+			packets = append(packets, buf.Bytes())
+			buf = &bytes.Buffer{}
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+
+	return append(packets, buf.Bytes())
+}
+
+// statsdNameSegment makes a tag value a metric name segment, only keeping letters, digits, - and _
+func statsdNameSegment(v string) string {
+	if v == "" {
+		return "none"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, v)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readPackets reads UDP packets until none comes for a while
+func readPackets(t *testing.T, pc net.PacketConn) []string {
+	packets := []string{}
+
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsdSinkDogStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newStatsdSink(pc.LocalAddr().String(), statsdFlavorDogStatsD, "proxysql.", []string{"schema", "username", "server_addr"}, 0, 1432, "")
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	logs[1].Duration = 1500 * time.Microsecond
+	logs[2].Schema = "a,b"
+	logs[2].ServerAddr = ""
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// aggregated by tag set, empty tags left out
+	require.Equal(t, []string{strings.Join([]string{
+		"proxysql.queries:1|c|#schema:a_b,username:didasy",
+		"proxysql.query.duration:0|ms|#schema:a_b,username:didasy",
+		"proxysql.queries:2|c|#schema:test,username:didasy,server_addr:127.0.0.1:3306",
+		"proxysql.query.duration:0:1.5|ms|#schema:test,username:didasy,server_addr:127.0.0.1:3306",
+	}, "\n")}, readPackets(t, pc))
+}
+
+func TestStatsdSinkStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newStatsdSink(pc.LocalAddr().String(), statsdFlavorStatsD, "", []string{"schema", "server_addr"}, 0, 64, "")
+	require.NoError(t, err)
+
+	logs := testESLines(t)
+	logs[1].Duration = 2 * time.Millisecond
+	logs[2].ServerAddr = ""
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+
+	// one timing a line, lines packed up to 64 bytes
+	require.Equal(t, []string{
+		"queries.test.none:1|c\nquery.duration.test.none:0|ms",
+		"queries.test.127_0_0_1_3306:2|c",
+		"query.duration.test.127_0_0_1_3306:0|ms",
+		"query.duration.test.127_0_0_1_3306:2|ms",
+	}, readPackets(t, pc))
+}
+
+func TestStatsdSinkFlushInterval(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newStatsdSink(pc.LocalAddr().String(), statsdFlavorDogStatsD, "", nil, 10*time.Millisecond, 1432, "")
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Write(testESLines(t)[0]))
+
+	// flushed without Close
+	require.Equal(t, []string{"queries:1|c\nquery.duration:0|ms"}, readPackets(t, pc))
+}
+
+func TestStatsdSinkRepeat(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	logs := testESLines(t)
+	tracker := newLineTracker()
+
+	open := func() *statsdSink {
+		s, err := newStatsdSink(pc.LocalAddr().String(), statsdFlavorDogStatsD, "", nil, 0, 1432, "queries.log")
+		require.NoError(t, err)
+		s.tracker = tracker
+
+		return s
+	}
+
+	s := open()
+	for _, l := range logs[:2] {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{"queries:2|c\nquery.duration:0:0|ms"}, readPackets(t, pc))
+
+	// decoding the same file again only sends the new lines
+	s = open()
+	for _, l := range logs {
+		require.NoError(t, s.Write(l))
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{"queries:1|c\nquery.duration:0|ms"}, readPackets(t, pc))
+}
+
+func TestStatsdSinkSampled(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newStatsdSink(pc.LocalAddr().String(), statsdFlavorDogStatsD, "", nil, 0, 1432, "")
+	require.NoError(t, err)
+	s.maxTimings = 2
+
+	l := testESLines(t)[0]
+	for i := 0; i < 8; i++ {
+		require.NoError(t, s.Write(l))
+	}
+
+	// the durations kept are bounded, the count stays exact
+	require.Len(t, s.series[""].durations, 2)
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{"queries:8|c\nquery.duration:0:0|ms|@0.25"}, readPackets(t, pc))
+}
+
+func TestStatsdSinkNegative(t *testing.T) {
+	_, err := newStatsdSink("localhost", statsdFlavorDogStatsD, "", nil, 0, 1432, "")
+	require.Error(t, err)
+
+	_, err = newStatsdSink("localhost:8125", "graphite", "", nil, 0, 1432, "")
+	require.Error(t, err)
+
+	_, err = newStatsdSink("localhost:8125", statsdFlavorDogStatsD, "", []string{"query"}, 0, 1432, "")
+	require.Error(t, err)
+
+	_, err = newStatsdSink("localhost:8125", statsdFlavorDogStatsD, "", nil, 0, 10, "")
+	require.Error(t, err)
+
+	// metrics are best effort, an unresolvable host is not an error
+	s, err := newStatsdSink("nonexistent.invalid:8125", statsdFlavorDogStatsD, "", nil, 0, 1432, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testESLines(t)[0]))
+	require.NoError(t, s.Close())
+}
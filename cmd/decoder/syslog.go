@@ -0,0 +1,322 @@
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	syslogRFC5424 = "rfc5424"
+	syslogRFC3164 = "rfc3164"
+
+	// syslogSDID is the structured data id of RFC 5424 messages,
+	// 32473 being the private enterprise number reserved for documentation
+	syslogSDID = "query@32473"
+
+	// syslogMaxDatagram is the size datagram messages are truncated to, long queries making messages
+	// larger than a udp datagram can be
+	syslogMaxDatagram = 8192
+
+	// syslogWriteTimeout bounds how long a message can wait for a stuck stream receiver
+	syslogWriteTimeout = 30 * time.Second
+)
+
+var (
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+		"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+
+	syslogSeverities = map[string]int{
+		"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+	}
+
+	// syslogSDEscaper escapes RFC 5424 structured data parameter values
+	syslogSDEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+)
+
+// syslogThreshold is the severity of queries lasting at least a duration
+type syslogThreshold struct {
+	duration time.Duration
+	severity int
+}
+
+// syslogSink sends every log line as a syslog message to a udp, tcp, tls or unix address.
+// Messages are octet counted over streams, tcp, tls and unix stream sockets, as in RFC 6587,
+// so queries spanning lines stay whole. Over datagrams they are truncated to syslogMaxDatagram bytes.
+// RFC 5424 messages carry the fields as structured data and the query as message, RFC 3164 messages
+// have no structured data so the fields are written as key=value pairs before the query.
+type syslogSink struct {
+	network    string
+	addr       string
+	protocol   string
+	facility   int
+	severity   int
+	thresholds []syslogThreshold
+	appName    string
+	hostname   string
+	tlsConfig  *tls.Config
+
+	conn   net.Conn
+	stream bool // whether conn is a stream, needing framing
+}
+
+func newSyslogSink(rawURL, protocol, facility, severity, bySeverity, appName, hostname, caFile string) (*syslogSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %s: %v", rawURL, err)
+	}
+
+	s := &syslogSink{
+		network:  u.Scheme,
+		addr:     u.Host,
+		protocol: protocol,
+		appName:  appName,
+		hostname: hostname,
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+		}
+	case "unix":
+		s.addr = u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog address %s, the scheme must be udp, tcp, tls or unix", rawURL)
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("invalid syslog address %s, it has no host or path", rawURL)
+	}
+
+	switch protocol {
+	case syslogRFC5424, syslogRFC3164:
+	default:
+		return nil, fmt.Errorf("unknown syslog protocol %s", protocol)
+	}
+
+	var ok bool
+	if s.facility, ok = syslogFacilities[facility]; !ok {
+		return nil, fmt.Errorf("unknown syslog facility %s", facility)
+	}
+
+	if s.severity, ok = syslogSeverities[severity]; !ok {
+		return nil, fmt.Errorf("unknown syslog severity %s", severity)
+	}
+
+	s.thresholds, err = parseSyslogThresholds(bySeverity)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+	}
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	if s.appName == "" {
+		s.appName = "-"
+	}
+
+	return s, nil
+}
+
+// parseSyslogThresholds parses comma separated duration=severity items, e.g. 1s=notice,10s=warning,
+// sorted by ascending duration
+func parseSyslogThresholds(s string) ([]syslogThreshold, error) {
+	thresholds := []syslogThreshold{}
+	for _, item := range splitList(s) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid syslog severity threshold %s, it must be duration=severity", item)
+		}
+
+		d, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog severity threshold %s: %v", item, err)
+		}
+
+		severity, ok := syslogSeverities[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog severity %s", parts[1])
+		}
+
+		thresholds = append(thresholds, syslogThreshold{duration: d, severity: severity})
+	}
+
+	sort.Slice(thresholds, func(i, j int) bool {
+		return thresholds[i].duration < thresholds[j].duration
+	})
+
+	return thresholds, nil
+}
+
+// Write sends a log line as a single message, connecting again once if the connection was lost
+func (s *syslogSink) Write(l *pxld.LogLine) error {
+	msg := s.format(l)
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			err = s.dial()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if err == nil {
+			_, err = s.conn.Write(s.frame(msg))
+		}
+		if err == nil {
+			return nil
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return fmt.Errorf("failed to send syslog message: %v", err)
+}
+
+// frame returns a message as written to the connection, octet counted over a stream
+// and truncated to syslogMaxDatagram bytes otherwise, without splitting a UTF-8 character
+func (s *syslogSink) frame(msg []byte) []byte {
+	if s.stream {
+		return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	if len(msg) <= syslogMaxDatagram {
+		return msg
+	}
+
+	n := syslogMaxDatagram
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+
+	return msg[:n]
+}
+
+// Close closes the connection
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+func (s *syslogSink) dial() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	stream := s.network != "udp"
+	switch s.network {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	case "unix":
+		// the local syslog socket is usually a datagram one
+		conn, err = dialer.Dial("unixgram", s.addr)
+		stream = false
+		if err != nil {
+			conn, err = dialer.Dial("unix", s.addr)
+			stream = true
+		}
+	default:
+		conn, err = dialer.Dial(s.network, s.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+
+	s.conn, s.stream = conn, stream
+
+	return nil
+}
+
+// severityOf returns the severity of the highest threshold reached by the duration of a query
+func (s *syslogSink) severityOf(l *pxld.LogLine) int {
+	severity := s.severity
+	for _, t := range s.thresholds {
+		if l.Duration >= t.duration {
+			severity = t.severity
+		}
+	}
+
+	return severity
+}
+
+// format returns a log line as a syslog message without framing
+func (s *syslogSink) format(l *pxld.LogLine) []byte {
+	buf := &bytes.Buffer{}
+	pri := s.facility*8 + s.severityOf(l)
+
+	fields := [][2]string{
+		{"thread_id", strconv.FormatUint(l.ThreadID, 10)},
+		{"username", l.Username},
+		{"schema", l.Schema},
+		{"client_addr", l.ClientAddr},
+		{"server_addr", l.ServerAddr},
+		{"query_digest", l.QueryDigest},
+		{"duration_ns", strconv.FormatInt(int64(l.Duration), 10)},
+		{"end_at", l.EndAt.UTC().Format(time.RFC3339Nano)},
+	}
+
+	if s.protocol == syslogRFC3164 {
+		// RFC 3164 has no time zone, so the local time is used like syslog daemons do
+		fmt.Fprintf(buf, "<%d>%s %s %s:", pri, l.StartAt.Local().Format(time.Stamp), s.hostname, s.appName)
+		for _, f := range fields {
+			if f[1] != "" {
+				fmt.Fprintf(buf, " %s=%s", f[0], strconv.Quote(f[1]))
+			}
+		}
+		buf.WriteString(" query=")
+		buf.WriteString(strconv.Quote(l.Query))
+
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(buf, "<%d>1 %s %s %s - query [%s", pri, l.StartAt.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.appName, syslogSDID)
+	for _, f := range fields {
+		if f[1] != "" {
+			fmt.Fprintf(buf, ` %s="%s"`, f[0], syslogSDEscaper.Replace(f[1]))
+		}
+	}
+	buf.WriteString("] ")
+	buf.WriteString(l.Query)
+
+	return buf.Bytes()
+}
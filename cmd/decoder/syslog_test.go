@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readOctetCounted reads n RFC 6587 octet counted messages
+func readOctetCounted(t *testing.T, conn net.Conn, n int) []string {
+	r := bufio.NewReader(conn)
+
+	msgs := []string{}
+	for i := 0; i < n; i++ {
+		size, err := r.ReadString(' ')
+		require.NoError(t, err)
+
+		length, err := strconv.Atoi(strings.TrimSpace(size))
+		require.NoError(t, err)
+
+		msg := make([]byte, length)
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+
+		msgs = append(msgs, string(msg))
+	}
+
+	return msgs
+}
+
+func TestSyslogSinkFormat(t *testing.T) {
+	s, err := newSyslogSink("udp://localhost:514", syslogRFC5424, "local0", "info", "10s=warning,1s=notice", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	l.Query = "select \"a]\"\nfrom t"
+	require.Equal(t, `<134>1 2019-04-10T08:08:00.727354Z db1 proxysql - query [query@32473 thread_id="21" username="didasy" schema="test" client_addr="127.0.0.1:33680" server_addr="127.0.0.1:3306" query_digest="0x426F13B3371DDF38" duration_ns="0" end_at="2019-04-10T08:08:00.727354Z"] select "a]"`+"\nfrom t", string(s.format(l)))
+
+	// the severity of the highest threshold reached
+	l.Duration = 2 * time.Second
+	require.True(t, strings.HasPrefix(string(s.format(l)), "<133>1 "))
+	l.Duration = time.Minute
+	require.True(t, strings.HasPrefix(string(s.format(l)), "<132>1 "))
+
+	s, err = newSyslogSink("udp://localhost:514", syslogRFC3164, "user", "notice", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	l.Duration = 0
+	stamp := l.StartAt.Local().Format(time.Stamp)
+	require.Equal(t, `<13>`+stamp+` db1 proxysql: thread_id="21" username="didasy" schema="test" client_addr="127.0.0.1:33680" server_addr="127.0.0.1:3306" query_digest="0x426F13B3371DDF38" duration_ns="0" end_at="2019-04-10T08:08:00.727354Z" query="select \"a]\"\nfrom t"`, string(s.format(l)))
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newSyslogSink("udp://"+pc.LocalAddr().String(), syslogRFC5424, "local0", "info", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+
+	buf := make([]byte, 65536)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, string(s.format(l)), string(buf[:n]))
+
+	// a long query is truncated rather than failing, without splitting a character
+	l.Query = "select '" + strings.Repeat("é", 70000) + "'"
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+
+	n, _, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.LessOrEqual(t, n, syslogMaxDatagram)
+	require.True(t, utf8.Valid(buf[:n]))
+	require.True(t, strings.HasPrefix(string(s.format(l)), string(buf[:n])))
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	msgs := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msgs <- readOctetCounted(t, conn, 2)
+	}()
+
+	s, err := newSyslogSink("tcp://"+ln.Addr().String(), syslogRFC5424, "local0", "info", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	l.Query = "select 1\nfrom dual"
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+
+	// queries spanning lines stay whole
+	require.Equal(t, []string{string(s.format(l)), string(s.format(l))}, <-msgs)
+}
+
+func TestSyslogSinkTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	msgs := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		msgs <- readOctetCounted(t, conn, 1)
+		conn.Close()
+
+		// let the next handshakes fail
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "pxld-syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the test certificate is valid for example.com and 127.0.0.1
+	ca := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+
+	s, err := newSyslogSink("tls://"+ln.Addr().String(), syslogRFC5424, "local0", "info", "", "proxysql", "db1", ca)
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{string(s.format(l))}, <-msgs)
+
+	// without the test certificate authority
+	s, err = newSyslogSink("tls://"+ln.Addr().String(), syslogRFC5424, "local0", "info", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+	require.Error(t, s.Write(l))
+}
+
+func TestSyslogSinkUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	pc, err := net.ListenPacket("unixgram", path)
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newSyslogSink("unix://"+path, syslogRFC3164, "local0", "info", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, string(s.format(l)), string(buf[:n]))
+}
+
+func TestSyslogSinkUnixStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxld-syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	msgs := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msgs <- readOctetCounted(t, conn, 2)
+	}()
+
+	s, err := newSyslogSink("unix://"+path, syslogRFC3164, "local0", "info", "", "proxysql", "db1", "")
+	require.NoError(t, err)
+
+	// framed like tcp, as stream sockets have no message boundaries
+	l := testESLines(t)[0]
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Write(l))
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{string(s.format(l)), string(s.format(l))}, <-msgs)
+}
+
+func TestSyslogSinkNegative(t *testing.T) {
+	for _, args := range [][]string{
+		{"http://localhost:514", syslogRFC5424, "local0", "info", ""},
+		{"udp://", syslogRFC5424, "local0", "info", ""},
+		{"udp://localhost:514", "rfc1", "local0", "info", ""},
+		{"udp://localhost:514", syslogRFC5424, "local8", "info", ""},
+		{"udp://localhost:514", syslogRFC5424, "local0", "loud", ""},
+		{"udp://localhost:514", syslogRFC5424, "local0", "info", "1s"},
+		{"udp://localhost:514", syslogRFC5424, "local0", "info", "soon=warning"},
+		{"udp://localhost:514", syslogRFC5424, "local0", "info", "1s=loud"},
+	} {
+		_, err := newSyslogSink(args[0], args[1], args[2], args[3], args[4], "proxysql", "", "")
+		require.Error(t, err, strings.Join(args, " "))
+	}
+
+	_, err := newSyslogSink("tls://localhost:6514", syslogRFC5424, "local0", "info", "", "proxysql", "", "/nonexistent/ca.pem")
+	require.Error(t, err)
+
+	// nothing listens there
+	s, err := newSyslogSink("tcp://127.0.0.1:1", syslogRFC5424, "local0", "info", "", "proxysql", "", "")
+	require.NoError(t, err)
+	require.Error(t, s.Write(testESLines(t)[0]))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/tiket-oss/go-pxld"
+
+	"crypto/sha1"
+	"sync"
+)
+
+// sourceProgress is how far the lines of a source were seen
+type sourceProgress struct {
+	first [sha1.Size]byte
+	end   int64
+}
+
+// lineTracker tells apart the lines of a source not seen yet, so the sinks emitting deltas like counters
+// only count the lines appended since the last run when decoding a file again with --repeat.
+// A different first line means the file was rotated, so it is seen from its start again.
+type lineTracker struct {
+	mu      sync.Mutex
+	sources map[string]*sourceProgress
+}
+
+func newLineTracker() *lineTracker {
+	return &lineTracker{sources: map[string]*sourceProgress{}}
+}
+
+// isNew reports whether a line of a source was not seen yet, marking it as seen.
+// Lines of an unnamed source, like server mode chunks, are always new.
+func (t *lineTracker) isNew(source string, l *pxld.LogLine) bool {
+	if source == "" {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.sources[source]
+	if !ok {
+		p = &sourceProgress{}
+		t.sources[source] = p
+	}
+
+	if l.Offset == 0 {
+		if first := sha1.Sum(l.RawMessage); first != p.first {
+			p.first, p.end = first, 0
+		}
+	}
+
+	if l.Offset < p.end {
+		return false
+	}
+	p.end = l.Offset + 8 + int64(l.MessageLength)
+
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineTracker(t *testing.T) {
+	tr := newLineTracker()
+	logs := testESLines(t)
+
+	for _, l := range logs[:2] {
+		require.True(t, tr.isNew("queries.log", l))
+	}
+
+	// another source is tracked apart
+	require.True(t, tr.isNew("other.log", logs[0]))
+
+	require.False(t, tr.isNew("queries.log", logs[0]))
+	require.False(t, tr.isNew("queries.log", logs[1]))
+	require.True(t, tr.isNew("queries.log", logs[2]))
+
+	// a rotated file starts with another line
+	rotated := *logs[0]
+	rotated.RawMessage = []byte("rotated")
+	require.True(t, tr.isNew("queries.log", &rotated))
+	require.True(t, tr.isNew("queries.log", logs[1]))
+
+	// lines of an unnamed source are always new
+	require.True(t, tr.isNew("", logs[0]))
+	require.True(t, tr.isNew("", logs[0]))
+}
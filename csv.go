@@ -0,0 +1,192 @@
+package pxld
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	// TimeFormatUnix formats times as UNIX seconds
+	TimeFormatUnix = "unix"
+	// TimeFormatUnixMilli formats times as UNIX milliseconds
+	TimeFormatUnixMilli = "unixmilli"
+	// TimeFormatUnixMicro formats times as UNIX microseconds, the precision of ProxySQL itself
+	TimeFormatUnixMicro = "unixmicro"
+)
+
+var (
+	// CSVColumns lists every column CSVWriter can write, named after the JSON fields of LogLine
+	CSVColumns = []string{
+		"message_length",
+		"raw_message",
+		"thread_id",
+		"username",
+		"schema",
+		"start_at",
+		"end_at",
+		"query_digest",
+		"hid",
+		"client_addr",
+		"server_addr",
+		"query",
+		"duration_ns",
+	}
+
+	// DefaultCSVColumns are the columns written when none is given, the raw message is left out
+	DefaultCSVColumns = []string{
+		"start_at",
+		"end_at",
+		"duration_ns",
+		"thread_id",
+		"username",
+		"schema",
+		"client_addr",
+		"hid",
+		"server_addr",
+		"query_digest",
+		"query",
+	}
+)
+
+// CSVWriter writes log lines as CSV, or TSV when Comma is a tab, with a header row.
+// Fields with a delimiter, a quote or a line break, like most multi-line queries, are quoted.
+// Every row is written as soon as it is given, like NDJSONWriter does.
+// Comma and TimeFormat must be set before the first Write.
+type CSVWriter struct {
+	Comma      rune   // field delimiter, ',' by default
+	TimeFormat string // Go time layout or one of the TimeFormat constants, time.RFC3339Nano by default
+	NoHeader   bool   // do not write the header row, e.g. when appending to a file having one
+
+	w             *csv.Writer
+	columns       []string
+	headerWritten bool
+}
+
+// NewCSVWriter returns a new writer that writes the given columns to w, DefaultCSVColumns if there is none
+func NewCSVWriter(w io.Writer, columns []string) (*CSVWriter, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+
+	for _, c := range columns {
+		if !isCSVColumn(c) {
+			return nil, fmt.Errorf("unknown column %s", c)
+		}
+	}
+
+	return &CSVWriter{
+		Comma:      ',',
+		TimeFormat: time.RFC3339Nano,
+		w:          csv.NewWriter(w),
+		columns:    columns,
+	}, nil
+}
+
+// Write writes a log line as a single record
+func (w *CSVWriter) Write(l *LogLine) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	record := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		record[i] = w.field(l, c)
+	}
+
+	err = w.w.Write(record)
+	if err != nil {
+		return err
+	}
+
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+// Close writes the header if nothing was written yet and flushes
+func (w *CSVWriter) Close() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+func (w *CSVWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+	w.w.Comma = w.Comma
+
+	if w.NoHeader {
+		return nil
+	}
+
+	return w.w.Write(w.columns)
+}
+
+func (w *CSVWriter) field(l *LogLine, column string) string {
+	switch column {
+	case "message_length":
+		return strconv.FormatUint(l.MessageLength, 10)
+	case "raw_message":
+		return base64.StdEncoding.EncodeToString(l.RawMessage)
+	case "thread_id":
+		return strconv.FormatUint(l.ThreadID, 10)
+	case "username":
+		return l.Username
+	case "schema":
+		return l.Schema
+	case "start_at":
+		return FormatTime(l.StartAt, w.TimeFormat)
+	case "end_at":
+		return FormatTime(l.EndAt, w.TimeFormat)
+	case "query_digest":
+		return l.QueryDigest
+	case "hid":
+		return strconv.FormatUint(l.HID, 10)
+	case "client_addr":
+		return l.ClientAddr
+	case "server_addr":
+		return l.ServerAddr
+	case "query":
+		return l.Query
+	case "duration_ns":
+		return strconv.FormatInt(int64(l.Duration), 10)
+	}
+
+	return ""
+}
+
+func isCSVColumn(column string) bool {
+	for _, c := range CSVColumns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormatTime formats t with a Go time layout or one of the TimeFormat constants
+func FormatTime(t time.Time, format string) string {
+	switch format {
+	case TimeFormatUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case TimeFormatUnixMilli:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case TimeFormatUnixMicro:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10)
+	}
+
+	return t.Format(format)
+}
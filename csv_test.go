@@ -0,0 +1,90 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSVWriter(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	multiline := *line
+	multiline.Query = "select *\nfrom test\nwhere name = \"a,b\""
+
+	buf := &bytes.Buffer{}
+	w, err := NewCSVWriter(buf, []string{"start_at", "username", "query"})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(line))
+
+	// written as soon as given, for pipelines
+	require.Equal(t, "start_at,username,query\n2019-04-10T15:08:00.727354+07:00,didasy,select * from test\n", buf.String())
+
+	require.NoError(t, w.Write(&multiline))
+	require.NoError(t, w.Close())
+
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"start_at", "username", "query"},
+		{"2019-04-10T15:08:00.727354+07:00", "didasy", "select * from test"},
+		{"2019-04-10T15:08:00.727354+07:00", "didasy", multiline.Query},
+	}, records)
+}
+
+func TestCSVWriterTSV(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	buf := &bytes.Buffer{}
+	w, err := NewCSVWriter(buf, []string{"thread_id", "start_at", "duration_ns", "query_digest"})
+	require.NoError(t, err)
+	w.Comma = '\t'
+	w.TimeFormat = TimeFormatUnixMicro
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, "thread_id\tstart_at\tduration_ns\tquery_digest\n21\t1554883680727354\t0\t0x426F13B3371DDF38\n", buf.String())
+}
+
+func TestCSVWriterNoHeader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewCSVWriter(buf, []string{"thread_id", "query"})
+	require.NoError(t, err)
+	w.NoHeader = true
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, "21,select * from test\n", buf.String())
+}
+
+func TestCSVWriterEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewCSVWriter(buf, nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{DefaultCSVColumns}, records)
+}
+
+func TestCSVWriterNegative(t *testing.T) {
+	_, err := NewCSVWriter(&bytes.Buffer{}, []string{"query", "nope"})
+	require.Error(t, err)
+}
+
+func TestFormatTime(t *testing.T) {
+	tm := time.Unix(1554883680, 727354000)
+
+	require.Equal(t, "1554883680", FormatTime(tm, TimeFormatUnix))
+	require.Equal(t, "1554883680727", FormatTime(tm, TimeFormatUnixMilli))
+	require.Equal(t, "1554883680727354", FormatTime(tm, TimeFormatUnixMicro))
+	require.Equal(t, "2019-04-10 08:08:00", FormatTime(tm.UTC(), "2006-01-02 15:04:05"))
+}
@@ -0,0 +1,164 @@
+package pxld
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// File gives random access to the log lines of a ProxySQL's query log file.
+// The offsets of its log lines are only found when a log line past the known ones is asked for,
+// and the file may keep growing while it is open. It is safe for concurrent use.
+type File struct {
+	f *os.File
+
+	mu      sync.Mutex
+	offsets []int64 // offsets of the log lines found so far
+	end     int64   // offset right after the last log line found so far
+}
+
+// OpenFile is used to open a ProxySQL's query log file for random access
+func OpenFile(fp string) (f *File, err error) {
+	var osf *os.File
+	osf, err = os.Open(fp)
+	if err != nil {
+		return
+	}
+
+	f = &File{f: osf}
+
+	return
+}
+
+// Close closes the underlying file
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// ReadAt is used to decode the log line starting at a byte offset, e.g. one from Decoder.Offset
+func (f *File) ReadAt(offset int64) (line *LogLine, err error) {
+	var fi os.FileInfo
+	fi, err = f.f.Stat()
+	if err != nil {
+		return
+	}
+	if offset < 0 || offset >= fi.Size() {
+		err = fmt.Errorf("offset %d is out of the file", offset)
+		return
+	}
+
+	// check the message length first, a wrong offset can give a huge one
+	data := make([]byte, 8)
+	_, err = f.f.ReadAt(data, offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+	if n := binary.LittleEndian.Uint64(data); n > uint64(fi.Size()-offset-8) {
+		err = fmt.Errorf("no log line at offset %d", offset)
+		return
+	}
+
+	// a section reader reads at its own position, so concurrent calls do not step on each other
+	line, err = decodeLine(io.NewSectionReader(f.f, offset, fi.Size()-offset))
+	if err != nil {
+		return
+	}
+	line.Offset = offset
+
+	return
+}
+
+// Record is used to decode the i-th log line, starting from 0, it returns io.EOF if there are not that many
+func (f *File) Record(i int) (line *LogLine, err error) {
+	var offset int64
+	offset, err = f.Offset(i)
+	if err != nil {
+		return
+	}
+
+	return f.ReadAt(offset)
+}
+
+// Offset returns the byte offset of the i-th log line, starting from 0, it returns io.EOF if there are not that many
+func (f *File) Offset(i int) (offset int64, err error) {
+	if i < 0 {
+		err = fmt.Errorf("invalid log line number %d", i)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if i >= len(f.offsets) {
+		err = f.scan(i)
+		if err != nil {
+			return
+		}
+	}
+
+	offset = f.offsets[i]
+
+	return
+}
+
+// Len returns the number of complete log lines in the file
+func (f *File) Len() (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err = f.scan(-1)
+	if err == io.EOF {
+		err = nil
+	}
+
+	n = len(f.offsets)
+
+	return
+}
+
+// scan is used to find log line offsets until the i-th one is known, or all of them if i is negative.
+// Only message lengths are read, the messages themselves are skipped.
+func (f *File) scan(i int) (err error) {
+	var fi os.FileInfo
+	fi, err = f.f.Stat()
+	if err != nil {
+		return
+	}
+	size := fi.Size()
+
+	r := bufio.NewReader(io.NewSectionReader(f.f, f.end, size-f.end))
+	data := make([]byte, 8)
+
+	for i < 0 || i >= len(f.offsets) {
+		_, err = io.ReadFull(r, data)
+		if err == io.ErrUnexpectedEOF {
+			// a log line still being written
+			err = io.EOF
+		}
+		if err != nil {
+			return
+		}
+
+		next := f.end + 8 + int64(binary.LittleEndian.Uint64(data))
+		if next > size || next < f.end {
+			err = io.EOF
+			return
+		}
+
+		_, err = r.Discard(int(next - f.end - 8))
+		if err != nil {
+			return
+		}
+
+		f.offsets = append(f.offsets, f.end)
+		f.end = next
+	}
+
+	return
+}
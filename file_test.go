@@ -0,0 +1,86 @@
+package pxld
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+
+	f, err := OpenFile(fp)
+	require.NoError(t, err)
+	defer f.Close()
+
+	l, err := f.Record(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), l.ThreadID)
+
+	offset, err := f.Offset(10)
+	require.NoError(t, err)
+
+	l, err = f.ReadAt(offset)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), l.ThreadID)
+	require.Equal(t, offset, l.Offset)
+
+	l, err = f.Record(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), l.ThreadID)
+
+	n, err := f.Len()
+	require.NoError(t, err)
+	require.Equal(t, 25, n)
+
+	// offsets match the ones of the sequential decoder
+	raw, err := ioutil.ReadFile(fp)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(raw)/25*24), f.offsets[24])
+
+	_, err = f.Record(25)
+	require.Equal(t, io.EOF, err)
+
+	// lines appended while the file is open are found
+	w, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = w.Write(encodeTestLine(25, base, "select 2"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	l, err = f.Record(25)
+	require.NoError(t, err)
+	require.Equal(t, "select 2", l.Query)
+}
+
+func TestFileNegative(t *testing.T) {
+	_, err := OpenFile("")
+	require.Error(t, err)
+
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 2)
+	defer os.Remove(fp)
+
+	f, err := OpenFile(fp)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Record(-1)
+	require.Error(t, err)
+
+	_, err = f.ReadAt(-1)
+	require.Error(t, err)
+
+	_, err = f.ReadAt(1 << 20)
+	require.Error(t, err)
+
+	// not at a log line boundary
+	_, err = f.ReadAt(3)
+	require.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package pxld
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+// GeneralLogWriter writes log lines as MySQL general query log lines, for replay and audit tools.
+// The first log line of a thread is preceded by a Connect, and by an Init DB whenever its schema changes afterwards.
+type GeneralLogWriter struct {
+	w       io.Writer
+	schemas map[uint64]string // current schema of every thread seen so far
+}
+
+// NewGeneralLogWriter returns a new writer that writes to w
+func NewGeneralLogWriter(w io.Writer) *GeneralLogWriter {
+	return &GeneralLogWriter{
+		w:       w,
+		schemas: map[uint64]string{},
+	}
+}
+
+// Write writes a log line as a Query, preceded by the Connect or Init DB it needs
+func (w *GeneralLogWriter) Write(l *LogLine) error {
+	buf := &bytes.Buffer{}
+
+	schema, seen := w.schemas[l.ThreadID]
+	if !seen {
+		host := l.ClientAddr
+		if h, _, err := net.SplitHostPort(l.ClientAddr); err == nil {
+			host = h
+		}
+
+		w.writeCommand(buf, l, "Connect", fmt.Sprintf("%s@%s on %s using TCP/IP", l.Username, host, l.Schema))
+	} else if schema != l.Schema {
+		w.writeCommand(buf, l, "Init DB", l.Schema)
+	}
+	w.schemas[l.ThreadID] = l.Schema
+
+	w.writeCommand(buf, l, "Query", l.Query)
+
+	_, err := buf.WriteTo(w.w)
+
+	return err
+}
+
+// Close does nothing as nothing is buffered
+func (w *GeneralLogWriter) Close() error {
+	return nil
+}
+
+func (w *GeneralLogWriter) writeCommand(buf *bytes.Buffer, l *LogLine, command, argument string) {
+	// MySQL logs a command when it receives it
+	fmt.Fprintf(buf, "%s\t%5d %s\t%s\n", l.StartAt.UTC().Format("2006-01-02T15:04:05.000000Z"), l.ThreadID, command, argument)
+}
@@ -0,0 +1,46 @@
+package pxld
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneralLogWriter(t *testing.T) {
+	l := &LogLine{
+		ThreadID:   21,
+		Username:   "didasy",
+		Schema:     "test",
+		ClientAddr: "127.0.0.1:33680",
+		StartAt:    time.Unix(1554883680, 727354000),
+		Query:      "select * from test",
+	}
+
+	sameSchema := *l
+	sameSchema.Query = "select 1"
+
+	otherSchema := *l
+	otherSchema.Schema = "prod"
+	otherSchema.Query = "select 2"
+
+	otherThread := *l
+	otherThread.ThreadID = 22
+	otherThread.Query = "select 3"
+
+	buf := &bytes.Buffer{}
+	w := NewGeneralLogWriter(buf)
+	for _, line := range []*LogLine{l, &sameSchema, &otherSchema, &otherThread} {
+		require.NoError(t, w.Write(line))
+	}
+	require.NoError(t, w.Close())
+
+	require.Equal(t, "2019-04-10T08:08:00.727354Z\t   21 Connect\tdidasy@127.0.0.1 on test using TCP/IP\n"+
+		"2019-04-10T08:08:00.727354Z\t   21 Query\tselect * from test\n"+
+		"2019-04-10T08:08:00.727354Z\t   21 Query\tselect 1\n"+
+		"2019-04-10T08:08:00.727354Z\t   21 Init DB\tprod\n"+
+		"2019-04-10T08:08:00.727354Z\t   21 Query\tselect 2\n"+
+		"2019-04-10T08:08:00.727354Z\t   22 Connect\tdidasy@127.0.0.1 on test using TCP/IP\n"+
+		"2019-04-10T08:08:00.727354Z\t   22 Query\tselect 3\n", buf.String())
+}
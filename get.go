@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"time"
 )
 
@@ -12,7 +13,7 @@ import (
 func GetMessageLength(dataStream io.Reader) (dataLength uint64, err error) {
 	data := make([]byte, 8)
 
-	_, err = dataStream.Read(data)
+	_, err = io.ReadFull(dataStream, data)
 	if err != nil {
 		return
 	}
@@ -106,8 +107,14 @@ func GetString(dataStream io.Reader) (s string, err error) {
 		return
 	}
 
+	// do not trust a length longer than what is left, e.g. when reading garbage
+	if l, ok := dataStream.(interface{ Len() int }); ok && n > uint64(l.Len()) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
 	raw := make([]byte, n)
-	_, err = dataStream.Read(raw)
+	_, err = io.ReadFull(dataStream, raw)
 	if err != nil {
 		return
 	}
@@ -122,7 +129,7 @@ func GetEncodedLength(dataStream io.Reader) (ln uint64, err error) {
 	// get first byte
 	lenFlag := make([]byte, 1)
 
-	_, err = dataStream.Read(lenFlag)
+	_, err = io.ReadFull(dataStream, lenFlag)
 	if err != nil {
 		return
 	}
@@ -134,7 +141,7 @@ func GetEncodedLength(dataStream io.Reader) (ln uint64, err error) {
 	} else if lenFlag[0] == 0xFC {
 		// get 2 bytes from data stream
 		tmp := make([]byte, 2)
-		_, err = dataStream.Read(tmp)
+		_, err = io.ReadFull(dataStream, tmp)
 		if err != nil {
 			return
 		}
@@ -144,7 +151,7 @@ func GetEncodedLength(dataStream io.Reader) (ln uint64, err error) {
 	} else if lenFlag[0] == 0xFD {
 		// get 3 bytes from data stream
 		tmp := make([]byte, 3)
-		_, err = dataStream.Read(tmp)
+		_, err = io.ReadFull(dataStream, tmp)
 		if err != nil {
 			return
 		}
@@ -154,7 +161,7 @@ func GetEncodedLength(dataStream io.Reader) (ln uint64, err error) {
 	} else if lenFlag[0] == 0xFE {
 		// get 8 bytes from data stream
 		tmp := make([]byte, 8)
-		_, err = dataStream.Read(tmp)
+		_, err = io.ReadFull(dataStream, tmp)
 		if err != nil {
 			return
 		}
@@ -165,20 +172,27 @@ func GetEncodedLength(dataStream io.Reader) (ln uint64, err error) {
 	return
 }
 
-// GetMessage is used to get the message from query log data
+// GetMessage is used to get the message from query log data. The message is read in growing chunks rather
+// than allocated at once, so a garbage length only costs the bytes the stream actually has.
 func GetMessage(messageLength uint64, dataStream io.Reader) (raw []byte, buf io.Reader, err error) {
-	raw = make([]byte, int(messageLength))
-
-	var n int
-	n, err = dataStream.Read(raw)
-	if err != nil {
+	if messageLength > math.MaxInt64 {
+		err = fmt.Errorf("message length %d is too large", messageLength)
 		return
 	}
-	if n != int(messageLength) {
+
+	msg := &bytes.Buffer{}
+
+	var n int64
+	n, err = io.CopyN(msg, dataStream, int64(messageLength))
+	if err == io.EOF {
 		err = fmt.Errorf("failed to read %d bytes, read %d bytes instead", messageLength, n)
 		return
 	}
+	if err != nil {
+		return
+	}
 
+	raw = msg.Bytes()
 	buf = bytes.NewReader(raw)
 
 	return
@@ -2,6 +2,7 @@ package pxld
 
 import (
 	"bytes"
+	"math"
 	"testing"
 	"time"
 
@@ -305,4 +306,11 @@ func TestMessageNegative(t *testing.T) {
 
 	_, _, err = GetMessage(2, buf)
 	require.Error(t, err)
+
+	// a garbage length is not allocated up front
+	_, _, err = GetMessage(1<<62, bytes.NewReader(data))
+	require.Error(t, err)
+
+	_, _, err = GetMessage(math.MaxUint64, bytes.NewReader(data))
+	require.Error(t, err)
 }
@@ -0,0 +1,377 @@
+package pxld
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// IndexExt is appended to a log file path to get the path of its sidecar index
+	IndexExt = ".idx"
+	// DefaultIndexInterval is the number of log lines covered by an index entry when none is given
+	DefaultIndexInterval = 1000
+)
+
+var (
+	// indexMagic is written at the start of every sidecar index
+	indexMagic = []byte("PXLDIDX2")
+)
+
+// IndexEntry describes a block of consecutive log lines in a log file
+type IndexEntry struct {
+	Offset     int64     // byte offset of the first log line of the block
+	MinStartAt time.Time // earliest query start time in the block
+	MaxStartAt time.Time // latest query start time in the block
+}
+
+// Index is a sparse time index of a log file, it has an entry every Interval log lines.
+// Query start times are only roughly ordered in a log file, so every entry keeps the time span of its block.
+type Index struct {
+	Interval int
+	Size     int64           // number of bytes of the log file covered by the index
+	Head     [sha1.Size]byte // SHA-1 of the raw message of the first log line, telling a rotated file apart
+	Entries  []IndexEntry
+}
+
+// IndexPath returns the path of the sidecar index of a log file
+func IndexPath(fp string) string {
+	return fp + IndexExt
+}
+
+// BuildIndex is used to build a time index of ProxySQL's query log data
+func BuildIndex(r io.Reader, interval int) (idx *Index, err error) {
+	if interval <= 0 {
+		interval = DefaultIndexInterval
+	}
+
+	idx = &Index{Interval: interval}
+	dec := NewDecoder(bufio.NewReader(r))
+
+	var entry *IndexEntry
+	for n := 0; ; n++ {
+		offset := dec.Offset()
+
+		var line *LogLine
+		line, err = dec.Decode()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		if n == 0 {
+			idx.Head = sha1.Sum(line.RawMessage)
+		}
+
+		if n%interval == 0 {
+			idx.Entries = append(idx.Entries, IndexEntry{
+				Offset:     offset,
+				MinStartAt: line.StartAt,
+				MaxStartAt: line.StartAt,
+			})
+			entry = &idx.Entries[len(idx.Entries)-1]
+		}
+
+		if line.StartAt.Before(entry.MinStartAt) {
+			entry.MinStartAt = line.StartAt
+		}
+		if line.StartAt.After(entry.MaxStartAt) {
+			entry.MaxStartAt = line.StartAt
+		}
+
+		idx.Size = dec.Offset()
+	}
+
+	return
+}
+
+// BuildIndexFile is used to build a time index of a ProxySQL's query log file and save it as its sidecar index
+func BuildIndexFile(fp string, interval int) (idx *Index, err error) {
+	var f *os.File
+	f, err = os.Open(fp)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	idx, err = BuildIndex(f, interval)
+	if err != nil {
+		return
+	}
+
+	// write to a temporary file first so readers never see a partial index
+	tmpPath := IndexPath(fp) + ".tmp"
+	var out *os.File
+	out, err = os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+
+	_, err = idx.WriteTo(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	err = os.Rename(tmpPath, IndexPath(fp))
+
+	return
+}
+
+// ReadIndex is used to read an index written by Index.WriteTo
+func ReadIndex(r io.Reader) (idx *Index, err error) {
+	magic := make([]byte, len(indexMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(indexMagic, magic) {
+		err = fmt.Errorf("not a valid pxld index")
+		return
+	}
+
+	var header struct {
+		Interval uint64
+		Size     uint64
+		Head     [sha1.Size]byte
+		Count    uint64
+	}
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+
+	// the count is not trusted to allocate the entries, a corrupt index fails on its missing entries instead
+	idx = &Index{
+		Interval: int(header.Interval),
+		Size:     int64(header.Size),
+		Head:     header.Head,
+		Entries:  []IndexEntry{},
+	}
+
+	for i := uint64(0); i < header.Count; i++ {
+		var raw [3]int64
+		err = binary.Read(r, binary.LittleEndian, &raw)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			idx = nil
+			return
+		}
+
+		// offsets of a valid index are ascending and within the covered size
+		if raw[0] < 0 || raw[0] >= idx.Size || (i > 0 && raw[0] <= idx.Entries[i-1].Offset) {
+			idx, err = nil, fmt.Errorf("invalid pxld index entry offset %d", raw[0])
+			return
+		}
+
+		idx.Entries = append(idx.Entries, IndexEntry{
+			Offset:     raw[0],
+			MinStartAt: time.Unix(0, raw[1]*1000),
+			MaxStartAt: time.Unix(0, raw[2]*1000),
+		})
+	}
+
+	return
+}
+
+// ReadIndexFile is used to read the sidecar index of a log file
+func ReadIndexFile(fp string) (idx *Index, err error) {
+	var f *os.File
+	f, err = os.Open(IndexPath(fp))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return ReadIndex(bufio.NewReader(f))
+}
+
+// WriteTo writes the index in its binary format, times are stored in UNIX microseconds like in the log itself
+func (idx *Index) WriteTo(w io.Writer) (n int64, err error) {
+	buf := &bytes.Buffer{}
+	buf.Write(indexMagic)
+	binary.Write(buf, binary.LittleEndian, []uint64{uint64(idx.Interval), uint64(idx.Size)})
+	buf.Write(idx.Head[:])
+	binary.Write(buf, binary.LittleEndian, uint64(len(idx.Entries)))
+
+	for _, e := range idx.Entries {
+		binary.Write(buf, binary.LittleEndian, []int64{
+			e.Offset,
+			e.MinStartAt.UnixNano() / 1000,
+			e.MaxStartAt.UnixNano() / 1000,
+		})
+	}
+
+	return buf.WriteTo(w)
+}
+
+// matches checks if the index was built from the log file r, by comparing the first log line with its Head
+func (idx *Index) matches(r io.Reader) bool {
+	var head [sha1.Size]byte
+
+	line, err := NewDecoder(bufio.NewReader(r)).Decode()
+	if err != nil && err != io.EOF {
+		return false
+	}
+	if err == nil {
+		head = sha1.Sum(line.RawMessage)
+	}
+
+	return head == idx.Head
+}
+
+// overlaps check if the block may contain a query started in [from, to)
+func (e IndexEntry) overlaps(from, to time.Time) bool {
+	if !from.IsZero() && e.MaxStartAt.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !e.MinStartAt.Before(to) {
+		return false
+	}
+
+	return true
+}
+
+// DecodeRange is used to decode log lines of a ProxySQL's query log file whose query started in [from, to).
+// It only decodes the blocks listed by the sidecar index that may contain such lines, plus everything appended
+// after the index was built. Without a usable index it falls back to SeekTime, see its caveat about ordering.
+func DecodeRange(fp string, from, to time.Time) (l []*LogLine, err error) {
+	var f *os.File
+	f, err = os.Open(fp)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var fi os.FileInfo
+	fi, err = f.Stat()
+	if err != nil {
+		return
+	}
+
+	// a missing index, or one of another file, e.g. after a rotation, can not be used
+	idx, ierr := ReadIndexFile(fp)
+	if ierr != nil || idx.Size > fi.Size() || !idx.matches(f) {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+
+		return decodeRangeUnindexed(f, from, to)
+	}
+
+	l = []*LogLine{}
+	var dec *Decoder
+
+	decodeUntil := func(end int64) (err error) {
+		for end < 0 || dec.Offset() < end {
+			var line *LogLine
+			line, err = dec.Decode()
+			if err == io.EOF && end < 0 {
+				return nil
+			}
+			if err != nil {
+				return
+			}
+
+			if line.StartedWithin(from, to) {
+				l = append(l, line)
+			}
+		}
+
+		return
+	}
+
+	seek := func(offset int64) (err error) {
+		if dec != nil && dec.Offset() == offset {
+			// already there after decoding the previous block
+			return
+		}
+
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return
+		}
+
+		dec = &Decoder{r: bufio.NewReader(f), offset: offset}
+
+		return
+	}
+
+	for i, e := range idx.Entries {
+		if !e.overlaps(from, to) {
+			continue
+		}
+
+		end := idx.Size
+		if i+1 < len(idx.Entries) {
+			end = idx.Entries[i+1].Offset
+		}
+
+		err = seek(e.Offset)
+		if err != nil {
+			return
+		}
+
+		err = decodeUntil(end)
+		if err != nil {
+			return
+		}
+	}
+
+	// lines appended after the index was built
+	err = seek(idx.Size)
+	if err != nil {
+		return
+	}
+
+	err = decodeUntil(-1)
+
+	return
+}
+
+// decodeRangeUnindexed is used to decode log lines started in [from, to), from the one SeekTime finds for from
+// until the end, as a line started after to may still be followed by one started before
+func decodeRangeUnindexed(r io.ReadSeeker, from, to time.Time) (l []*LogLine, err error) {
+	var offset int64
+	if !from.IsZero() {
+		offset, err = SeekTime(r, from)
+		if err != nil {
+			return
+		}
+	}
+
+	l = []*LogLine{}
+	dec := &Decoder{r: bufio.NewReader(r), offset: offset}
+	for {
+		var line *LogLine
+		line, err = dec.Decode()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		// start times are only roughly ascending, so a line started after to does not end the range
+		if line.StartedWithin(from, to) {
+			l = append(l, line)
+		}
+	}
+
+	return
+}
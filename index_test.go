@@ -0,0 +1,236 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTestLine builds a log line without server address in ProxySQL's binary format
+func encodeTestLine(threadID uint64, startAt time.Time, query string) []byte {
+	msg := &bytes.Buffer{}
+	msg.WriteByte(ProxySQLQuery)
+
+	putString := func(s string) {
+		msg.WriteByte(byte(len(s)))
+		msg.WriteString(s)
+	}
+	putUint64 := func(n uint64) {
+		msg.WriteByte(0xFE)
+		binary.Write(msg, binary.LittleEndian, n)
+	}
+
+	putUint64(threadID)
+	putString("didasy")
+	putString("test")
+	putString("127.0.0.1:33680")
+	putUint64(^uint64(0))
+	putUint64(uint64(startAt.UnixNano() / 1000))
+	putUint64(uint64(startAt.UnixNano() / 1000))
+	putUint64(0x38DF1D37B3136F42)
+	putString(query)
+
+	raw := make([]byte, 8, 8+msg.Len())
+	binary.LittleEndian.PutUint64(raw, uint64(msg.Len()))
+
+	return append(raw, msg.Bytes()...)
+}
+
+// writeTestLog writes n log lines starting one second apart from base and returns the file path
+func writeTestLog(t *testing.T, base time.Time, n int) string {
+	f, err := ioutil.TempFile("", "test.log")
+	require.NoError(t, err)
+	defer f.Close()
+
+	for i := 0; i < n; i++ {
+		_, err = f.Write(encodeTestLine(uint64(i), base.Add(time.Duration(i)*time.Second), "select 1"))
+		require.NoError(t, err)
+	}
+
+	return f.Name()
+}
+
+func TestBuildIndex(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+
+	raw, err := ioutil.ReadFile(fp)
+	require.NoError(t, err)
+
+	idx, err := BuildIndex(bytes.NewReader(raw), 10)
+	require.NoError(t, err)
+	require.Equal(t, 10, idx.Interval)
+	require.Equal(t, int64(len(raw)), idx.Size)
+	require.Len(t, idx.Entries, 3)
+	require.Equal(t, int64(0), idx.Entries[0].Offset)
+	require.Equal(t, base, idx.Entries[0].MinStartAt)
+	require.Equal(t, base.Add(9*time.Second), idx.Entries[0].MaxStartAt)
+	require.Equal(t, int64(len(raw)/25*10), idx.Entries[1].Offset)
+
+	buf := &bytes.Buffer{}
+	_, err = idx.WriteTo(buf)
+	require.NoError(t, err)
+
+	read, err := ReadIndex(buf)
+	require.NoError(t, err)
+	require.Equal(t, idx, read)
+}
+
+func TestReadIndexNegative(t *testing.T) {
+	_, err := ReadIndex(bytes.NewReader([]byte("NOTANIDX")))
+	require.Error(t, err)
+
+	_, err = ReadIndex(bytes.NewReader(indexMagic))
+	require.Error(t, err)
+
+	header := func(size, count uint64) *bytes.Buffer {
+		buf := bytes.NewBuffer(append([]byte{}, indexMagic...))
+		binary.Write(buf, binary.LittleEndian, []uint64{10, size})
+		buf.Write(make([]byte, 20))
+		binary.Write(buf, binary.LittleEndian, count)
+
+		return buf
+	}
+
+	// a corrupt count is not allocated, the missing entries are an error
+	_, err = ReadIndex(header(1000, 1<<62))
+	require.Error(t, err)
+
+	// entries out of order or out of the covered size
+	buf := header(1000, 2)
+	binary.Write(buf, binary.LittleEndian, []int64{500, 0, 0, 100, 0, 0})
+	_, err = ReadIndex(buf)
+	require.Error(t, err)
+
+	buf = header(1000, 1)
+	binary.Write(buf, binary.LittleEndian, []int64{1000, 0, 0})
+	_, err = ReadIndex(buf)
+	require.Error(t, err)
+}
+
+func TestDecodeRange(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+	defer os.Remove(IndexPath(fp))
+
+	check := func() {
+		ls, err := DecodeRange(fp, base.Add(12*time.Second), base.Add(15*time.Second))
+		require.NoError(t, err)
+		require.Len(t, ls, 3)
+		require.Equal(t, uint64(12), ls[0].ThreadID)
+		require.Equal(t, uint64(14), ls[2].ThreadID)
+
+		ls, err = DecodeRange(fp, base.Add(20*time.Second), time.Time{})
+		require.NoError(t, err)
+		require.Len(t, ls, 5)
+	}
+
+	// without index
+	check()
+
+	// with index
+	_, err := BuildIndexFile(fp, 10)
+	require.NoError(t, err)
+	check()
+
+	// blocks out of range are not decoded at all, so corrupting the first one past its first line does not matter
+	f, err := os.OpenFile(fp, os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xFF}, int64(len(encodeTestLine(0, base, "select 1")))+8)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	check()
+
+	// lines appended after the index was built are still found
+	f, err = os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(encodeTestLine(25, base.Add(13*time.Second), "select 2"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	ls, err := DecodeRange(fp, base.Add(12*time.Second), base.Add(15*time.Second))
+	require.NoError(t, err)
+	require.Len(t, ls, 4)
+	require.Equal(t, "select 2", ls[3].Query)
+}
+
+func TestDecodeRangeCorruptIndex(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+	defer os.Remove(IndexPath(fp))
+
+	_, err := BuildIndexFile(fp, 10)
+	require.NoError(t, err)
+
+	// a truncated index is not used
+	raw, err := ioutil.ReadFile(IndexPath(fp))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(IndexPath(fp), raw[:len(raw)-10], 0644))
+	_, err = ReadIndexFile(fp)
+	require.Error(t, err)
+
+	ls, err := DecodeRange(fp, base.Add(12*time.Second), base.Add(15*time.Second))
+	require.NoError(t, err)
+	require.Len(t, ls, 3)
+}
+
+func TestDecodeRangeOutOfOrder(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+	defer os.Remove(IndexPath(fp))
+
+	// a long query logged after queries started past the range
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(encodeTestLine(25, base.Add(13*time.Second), "select sleep(20)"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	check := func() {
+		ls, err := DecodeRange(fp, base.Add(12*time.Second), base.Add(15*time.Second))
+		require.NoError(t, err)
+		require.Len(t, ls, 4)
+		require.Equal(t, "select sleep(20)", ls[3].Query)
+	}
+
+	// the same lines with and without index
+	check()
+
+	_, err = BuildIndexFile(fp, 10)
+	require.NoError(t, err)
+	check()
+}
+
+func TestDecodeRangeRotated(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	fp := writeTestLog(t, base, 25)
+	defer os.Remove(fp)
+	defer os.Remove(IndexPath(fp))
+
+	_, err := BuildIndexFile(fp, 10)
+	require.NoError(t, err)
+
+	// a rotated file of the same size is not decoded with the index of the previous one
+	rotated := writeTestLog(t, base.Add(time.Hour), 25)
+	defer os.Remove(rotated)
+	require.NoError(t, os.Rename(rotated, fp))
+
+	ls, err := DecodeRange(fp, base.Add(time.Hour+12*time.Second), base.Add(time.Hour+15*time.Second))
+	require.NoError(t, err)
+	require.Len(t, ls, 3)
+	require.Equal(t, uint64(12), ls[0].ThreadID)
+}
+
+func TestDecodeRangeNegative(t *testing.T) {
+	_, err := DecodeRange("", time.Time{}, time.Time{})
+	require.Error(t, err)
+}
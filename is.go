@@ -15,7 +15,7 @@ const (
 func IsProxySQLQuery(dataStream io.Reader) (err error) {
 	data := make([]byte, 1)
 
-	_, err = dataStream.Read(data)
+	_, err = io.ReadFull(dataStream, data)
 	if err != nil {
 		return
 	}
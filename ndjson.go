@@ -0,0 +1,31 @@
+package pxld
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// NDJSONWriter writes log lines as newline delimited JSON, one compact object per line.
+// Every log line is written as soon as it is given, so it suits pipelines and log shippers.
+type NDJSONWriter struct {
+	enc *json.Encoder
+}
+
+// NewNDJSONWriter returns a new writer that writes to w
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	enc := json.NewEncoder(w)
+	// queries are full of < and >, keep them readable
+	enc.SetEscapeHTML(false)
+
+	return &NDJSONWriter{enc: enc}
+}
+
+// Write writes a log line as a single line of JSON
+func (w *NDJSONWriter) Write(l *LogLine) error {
+	return w.enc.Encode(l)
+}
+
+// Close does nothing as nothing is buffered
+func (w *NDJSONWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNDJSONWriter(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	other := *line
+	other.Query = "select * from test where id < 10"
+
+	buf := &bytes.Buffer{}
+	w := NewNDJSONWriter(buf)
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Write(&other))
+	require.NoError(t, w.Close())
+
+	rows := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, rows, 2)
+	require.Contains(t, rows[1], `"query":"select * from test where id < 10"`)
+
+	// the same fields as LogLine.String, just compact
+	compact := &bytes.Buffer{}
+	require.NoError(t, json.Compact(compact, []byte(lineJSON)))
+	require.Equal(t, compact.String(), rows[0])
+}
@@ -23,6 +23,7 @@ type LogLine struct {
 	ServerAddr    string        `json:"server_addr,omitempty"` // this depends on HID value
 	Query         string        `json:"query"`
 	Duration      time.Duration `json:"duration_ns"`
+	Offset        int64         `json:"-"` // byte offset of the log line in its stream, where the decoder started being 0
 }
 
 func (l *LogLine) String() string {
@@ -31,14 +32,57 @@ func (l *LogLine) String() string {
 	return string(raw)
 }
 
+// StartedWithin check if the query started in [from, to), a zero from or to leaves that side unbounded
+func (l *LogLine) StartedWithin(from, to time.Time) bool {
+	if !from.IsZero() && l.StartAt.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !l.StartAt.Before(to) {
+		return false
+	}
+
+	return true
+}
+
+// Decoder reads and decodes ProxySQL's query log lines from an input stream one at a time
+type Decoder struct {
+	r      io.Reader
+	offset int64
+}
+
+// NewDecoder returns a new decoder that reads from r, it never seeks so r can be a pipe or a socket
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next log line from the input stream, it returns io.EOF when there is no more line to read
+func (d *Decoder) Decode() (line *LogLine, err error) {
+	line, err = decodeLine(d.r)
+	if err != nil {
+		return
+	}
+	line.Offset = d.offset
+
+	// the message length itself is 8 bytes and is not counted in it
+	d.offset += 8 + int64(line.MessageLength)
+
+	return
+}
+
+// Offset returns the byte offset of the next log line relative to where the decoder started reading
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
 // Decode is used to decode a ProxySQL's query log data into a slice of LogLine
 func Decode(r io.Reader) (l []*LogLine, err error) {
 	l = []*LogLine{}
+	dec := NewDecoder(r)
 
 	// read until encountering EOF or unexpected error
 	for {
 		var line *LogLine
-		line, err = decodeLine(r)
+		line, err = dec.Decode()
 		if err != nil {
 			break
 		}
@@ -81,7 +125,14 @@ func decodeLine(dataStream io.Reader) (line *LogLine, err error) {
 		return
 	}
 
-	// then consume the next 1 byte, if 0 proceed, if not 0
+	err = decodeMessage(line, dataStream)
+
+	return
+}
+
+// decodeMessage fills line with the fields read from dataStream, which holds the message without its length
+func decodeMessage(line *LogLine, dataStream io.Reader) (err error) {
+	// first consume the next 1 byte, if 0 proceed, if not 0
 	// then just return with error as this is not a valid ProxySQL Query Log
 	err = IsProxySQLQuery(dataStream)
 	if err != nil {
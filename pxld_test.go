@@ -3,8 +3,10 @@ package pxld
 import (
 	"bytes"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -91,6 +93,36 @@ func TestDecode(t *testing.T) {
 	require.Equal(t, []*LogLine{line}, ls)
 }
 
+func TestDecoder(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	// a reader returning one byte at a time behaves like a slow pipe
+	data := append(append([]byte{}, testData...), testData...)
+	dec := NewDecoder(iotest.OneByteReader(bytes.NewReader(data)))
+
+	for i := 0; i < 2; i++ {
+		l, err := dec.Decode()
+		require.NoError(t, err)
+
+		expected := *line
+		expected.Offset = int64(i * len(testData))
+		require.Equal(t, &expected, l)
+	}
+
+	_, err := dec.Decode()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(testData[:20]))
+
+	_, err := dec.Decode()
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+}
+
 func TestDecodeFile(t *testing.T) {
 	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
 	line.StartAt = tm
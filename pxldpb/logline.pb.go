@@ -0,0 +1,176 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: pxldpb/logline.proto
+
+package pxldpb
+
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// LogLine is a decoded ProxySQL query log line.
+// Fields are only ever added with new numbers, a number is never reused.
+type LogLine struct {
+	ThreadId   uint64 `protobuf:"varint,1,opt,name=thread_id,json=threadId,proto3" json:"thread_id,omitempty"`
+	Username   string `protobuf:"bytes,2,opt,name=username,proto3" json:"username,omitempty"`
+	Schema     string `protobuf:"bytes,3,opt,name=schema,proto3" json:"schema,omitempty"`
+	ClientAddr string `protobuf:"bytes,4,opt,name=client_addr,json=clientAddr,proto3" json:"client_addr,omitempty"`
+	// HID is 18446744073709551615 when there is no server address.
+	Hid        uint64 `protobuf:"varint,5,opt,name=hid,proto3" json:"hid,omitempty"`
+	ServerAddr string `protobuf:"bytes,6,opt,name=server_addr,json=serverAddr,proto3" json:"server_addr,omitempty"`
+	// Query start time in UNIX microseconds.
+	StartAtUs int64 `protobuf:"varint,7,opt,name=start_at_us,json=startAtUs,proto3" json:"start_at_us,omitempty"`
+	// Query end time in UNIX microseconds.
+	EndAtUs              int64    `protobuf:"varint,8,opt,name=end_at_us,json=endAtUs,proto3" json:"end_at_us,omitempty"`
+	DurationNs           int64    `protobuf:"varint,9,opt,name=duration_ns,json=durationNs,proto3" json:"duration_ns,omitempty"`
+	QueryDigest          string   `protobuf:"bytes,10,opt,name=query_digest,json=queryDigest,proto3" json:"query_digest,omitempty"`
+	Query                string   `protobuf:"bytes,11,opt,name=query,proto3" json:"query,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LogLine) Reset()         { *m = LogLine{} }
+func (m *LogLine) String() string { return proto.CompactTextString(m) }
+func (*LogLine) ProtoMessage()    {}
+func (*LogLine) Descriptor() ([]byte, []int) {
+	return fileDescriptor_abbdba95dd375693, []int{0}
+}
+
+func (m *LogLine) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LogLine.Unmarshal(m, b)
+}
+func (m *LogLine) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LogLine.Marshal(b, m, deterministic)
+}
+func (m *LogLine) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LogLine.Merge(m, src)
+}
+func (m *LogLine) XXX_Size() int {
+	return xxx_messageInfo_LogLine.Size(m)
+}
+func (m *LogLine) XXX_DiscardUnknown() {
+	xxx_messageInfo_LogLine.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LogLine proto.InternalMessageInfo
+
+func (m *LogLine) GetThreadId() uint64 {
+	if m != nil {
+		return m.ThreadId
+	}
+	return 0
+}
+
+func (m *LogLine) GetUsername() string {
+	if m != nil {
+		return m.Username
+	}
+	return ""
+}
+
+func (m *LogLine) GetSchema() string {
+	if m != nil {
+		return m.Schema
+	}
+	return ""
+}
+
+func (m *LogLine) GetClientAddr() string {
+	if m != nil {
+		return m.ClientAddr
+	}
+	return ""
+}
+
+func (m *LogLine) GetHid() uint64 {
+	if m != nil {
+		return m.Hid
+	}
+	return 0
+}
+
+func (m *LogLine) GetServerAddr() string {
+	if m != nil {
+		return m.ServerAddr
+	}
+	return ""
+}
+
+func (m *LogLine) GetStartAtUs() int64 {
+	if m != nil {
+		return m.StartAtUs
+	}
+	return 0
+}
+
+func (m *LogLine) GetEndAtUs() int64 {
+	if m != nil {
+		return m.EndAtUs
+	}
+	return 0
+}
+
+func (m *LogLine) GetDurationNs() int64 {
+	if m != nil {
+		return m.DurationNs
+	}
+	return 0
+}
+
+func (m *LogLine) GetQueryDigest() string {
+	if m != nil {
+		return m.QueryDigest
+	}
+	return ""
+}
+
+func (m *LogLine) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*LogLine)(nil), "pxld.LogLine")
+}
+
+func init() {
+	proto.RegisterFile("pxldpb/logline.proto", fileDescriptor_abbdba95dd375693)
+}
+
+var fileDescriptor_abbdba95dd375693 = []byte{
+	// 291 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x3c, 0x91, 0xcf, 0x4a, 0x33, 0x31,
+	0x14, 0xc5, 0x99, 0xfe, 0x9f, 0x3b, 0xdf, 0xe2, 0x23, 0x14, 0x09, 0x15, 0x6c, 0x55, 0x84, 0x6e,
+	0xda, 0x59, 0xf8, 0x04, 0x15, 0x37, 0x42, 0x71, 0x51, 0x70, 0xe3, 0x26, 0xa4, 0xbd, 0x97, 0x99,
+	0xe0, 0x34, 0xa9, 0x49, 0x46, 0xf4, 0xfd, 0x7c, 0x30, 0x99, 0x9b, 0xea, 0x2e, 0xe7, 0xf7, 0xe3,
+	0x70, 0xe1, 0x04, 0xa6, 0xa7, 0xcf, 0x06, 0x4f, 0xfb, 0xb2, 0x71, 0x55, 0x63, 0x2c, 0xad, 0x4f,
+	0xde, 0x45, 0x27, 0x06, 0x1d, 0xbd, 0xf9, 0xee, 0xc1, 0x78, 0xeb, 0xaa, 0xad, 0xb1, 0x24, 0x2e,
+	0x21, 0x8f, 0xb5, 0x27, 0x8d, 0xca, 0xa0, 0xcc, 0x16, 0xd9, 0x72, 0xb0, 0x9b, 0x24, 0xf0, 0x84,
+	0x62, 0x06, 0x93, 0x36, 0x90, 0xb7, 0xfa, 0x48, 0xb2, 0xb7, 0xc8, 0x96, 0xf9, 0xee, 0x2f, 0x8b,
+	0x0b, 0x18, 0x85, 0x43, 0x4d, 0x47, 0x2d, 0xfb, 0x6c, 0xce, 0x49, 0xcc, 0xa1, 0x38, 0x34, 0x86,
+	0x6c, 0x54, 0x1a, 0xd1, 0xcb, 0x01, 0x4b, 0x48, 0x68, 0x83, 0xe8, 0xc5, 0x7f, 0xe8, 0xd7, 0x06,
+	0xe5, 0x90, 0x6f, 0x75, 0xcf, 0xae, 0x12, 0xc8, 0x7f, 0x90, 0x4f, 0x95, 0x51, 0xaa, 0x24, 0xc4,
+	0x95, 0x2b, 0x28, 0x42, 0xd4, 0x3e, 0x2a, 0x1d, 0x55, 0x1b, 0xe4, 0x78, 0x91, 0x2d, 0xfb, 0xbb,
+	0x9c, 0xd1, 0x26, 0xbe, 0x04, 0x31, 0x83, 0x9c, 0x2c, 0x9e, 0xed, 0x84, 0xed, 0x98, 0x2c, 0xb2,
+	0x9b, 0x43, 0x81, 0xad, 0xd7, 0xd1, 0x38, 0xab, 0x6c, 0x90, 0x39, 0x5b, 0xf8, 0x45, 0xcf, 0x41,
+	0x5c, 0xc3, 0xbf, 0xf7, 0x96, 0xfc, 0x97, 0x42, 0x53, 0x51, 0x88, 0x12, 0xf8, 0x7c, 0xc1, 0xec,
+	0x91, 0x91, 0x98, 0xc2, 0x90, 0xa3, 0x2c, 0xd8, 0xa5, 0xf0, 0x70, 0xf7, 0x7a, 0x5b, 0x99, 0x58,
+	0xb7, 0xfb, 0xf5, 0xc1, 0x1d, 0xcb, 0x68, 0xde, 0x28, 0xae, 0x5c, 0x08, 0x65, 0xe5, 0x56, 0xdd,
+	0xcc, 0x65, 0xfa, 0x81, 0xfd, 0x88, 0xa7, 0xbf, 0xff, 0x19, 0x00, 0xad, 0xdb, 0x5d, 0x6f, 0x92,
+	0x01, 0x00, 0x00,
+}
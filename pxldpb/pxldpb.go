@@ -0,0 +1,95 @@
+// Package pxldpb is the protobuf contract of decoded ProxySQL query log lines, see logline.proto.
+// Log lines are streamed length-delimited, every message is prefixed by its size as a varint.
+package pxldpb
+
+//go:generate protoc -I .. --go_out=paths=source_relative:.. ../pxldpb/logline.proto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tiket-oss/go-pxld"
+)
+
+const (
+	// maxMessageSize is the size of the biggest message ReadDelimited accepts
+	maxMessageSize = 1 << 30
+)
+
+// FromLogLine converts a decoded log line to its protobuf message
+func FromLogLine(l *pxld.LogLine) *LogLine {
+	return &LogLine{
+		ThreadId:    l.ThreadID,
+		Username:    l.Username,
+		Schema:      l.Schema,
+		ClientAddr:  l.ClientAddr,
+		Hid:         l.HID,
+		ServerAddr:  l.ServerAddr,
+		StartAtUs:   l.StartAt.UnixNano() / int64(time.Microsecond),
+		EndAtUs:     l.EndAt.UnixNano() / int64(time.Microsecond),
+		DurationNs:  int64(l.Duration),
+		QueryDigest: l.QueryDigest,
+		Query:       l.Query,
+	}
+}
+
+// DelimitedWriter writes log lines as a stream of length-delimited protobuf messages
+type DelimitedWriter struct {
+	w io.Writer
+}
+
+// NewDelimitedWriter returns a new writer that writes to w
+func NewDelimitedWriter(w io.Writer) *DelimitedWriter {
+	return &DelimitedWriter{w: w}
+}
+
+// Write writes a log line as its size followed by its protobuf message
+func (w *DelimitedWriter) Write(l *pxld.LogLine) error {
+	raw, err := proto.Marshal(FromLogLine(l))
+	if err != nil {
+		return err
+	}
+
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(raw)))
+
+	_, err = w.w.Write(append(size[:n], raw...))
+
+	return err
+}
+
+// Close does nothing as nothing is buffered
+func (w *DelimitedWriter) Close() error {
+	return nil
+}
+
+// ReadDelimited reads the next length-delimited message from r, it returns io.EOF when there is no more message
+func ReadDelimited(r *bufio.Reader) (m *LogLine, err error) {
+	var size uint64
+	size, err = binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if size > maxMessageSize {
+		err = fmt.Errorf("message of %d bytes is too big", size)
+		return
+	}
+
+	raw := make([]byte, size)
+	_, err = io.ReadFull(r, raw)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+
+	m = &LogLine{}
+	err = proto.Unmarshal(raw, m)
+
+	return
+}
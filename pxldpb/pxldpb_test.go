@@ -0,0 +1,79 @@
+package pxldpb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"github.com/tiket-oss/go-pxld"
+)
+
+var line = &pxld.LogLine{
+	MessageLength: 92,
+	ThreadID:      21,
+	Username:      "didasy",
+	Schema:        "test",
+	StartAt:       time.Unix(1554883680, 727354000),
+	EndAt:         time.Unix(1554883680, 827354000),
+	Duration:      100 * time.Millisecond,
+	QueryDigest:   "0x426F13B3371DDF38",
+	HID:           1,
+	ClientAddr:    "127.0.0.1:33680",
+	ServerAddr:    "127.0.0.1:3306",
+	Query:         "select * from test",
+}
+
+func TestFromLogLine(t *testing.T) {
+	m := FromLogLine(line)
+
+	require.True(t, proto.Equal(&LogLine{
+		ThreadId:    21,
+		Username:    "didasy",
+		Schema:      "test",
+		ClientAddr:  "127.0.0.1:33680",
+		Hid:         1,
+		ServerAddr:  "127.0.0.1:3306",
+		StartAtUs:   1554883680727354,
+		EndAtUs:     1554883680827354,
+		DurationNs:  int64(100 * time.Millisecond),
+		QueryDigest: "0x426F13B3371DDF38",
+		Query:       "select * from test",
+	}, m))
+}
+
+func TestDelimitedWriter(t *testing.T) {
+	noServer := *line
+	noServer.HID = ^uint64(0)
+	noServer.ServerAddr = ""
+
+	buf := &bytes.Buffer{}
+	w := NewDelimitedWriter(buf)
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Write(&noServer))
+	require.NoError(t, w.Close())
+
+	r := bufio.NewReader(buf)
+
+	m, err := ReadDelimited(r)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(FromLogLine(line), m))
+
+	m, err = ReadDelimited(r)
+	require.NoError(t, err)
+	require.Equal(t, ^uint64(0), m.GetHid())
+	require.Equal(t, "", m.GetServerAddr())
+
+	_, err = ReadDelimited(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReadDelimitedNegative(t *testing.T) {
+	// size without its message
+	_, err := ReadDelimited(bufio.NewReader(bytes.NewReader([]byte{0x05, 0x08})))
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+}
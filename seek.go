@@ -0,0 +1,196 @@
+package pxld
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	// minMessageLength is the length of the smallest possible message, one byte for every field
+	minMessageLength = 10
+	// maxResyncMessageLength is the length of the longest message considered while resynchronizing,
+	// a longer real log line is skipped and the next one is used instead
+	maxResyncMessageLength = 16 << 20
+	// resyncWindow is the number of bytes scanned at once while looking for a log line
+	resyncWindow = 64 << 10
+	// seekLinearThreshold is the distance under which SeekTime stops bisecting and decodes sequentially
+	seekLinearThreshold = 256 << 10
+)
+
+// SeekTime is used to move r to the first log line whose query started at or after t, without any index.
+// It bisects the log by jumping to byte offsets and resynchronizing to the next valid log line, so it only
+// reads a logarithmic part of the log. ProxySQL writes a log line when its query ends, so start times are only
+// roughly ascending and a line started around t but written far from its neighbours may end up on either side.
+// It returns the offset r is moved to, which is the end of the log when every query started before t.
+func SeekTime(r io.ReadSeeker, t time.Time) (offset int64, err error) {
+	var size int64
+	size, err = r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+
+	// lo is always a log line boundary before t, hi is an upper bound of the answer
+	lo, hi := int64(0), size
+	for hi-lo > seekLinearThreshold {
+		mid := lo + (hi-lo)/2
+
+		var (
+			at   int64
+			line *LogLine
+		)
+		at, line, err = resync(r, mid, size)
+		if err == io.EOF {
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if at >= hi {
+			hi = mid
+		} else if line.StartAt.Before(t) {
+			lo = at + 8 + int64(line.MessageLength)
+		} else {
+			hi = at
+		}
+	}
+
+	// then look for the first line at or after t from the last known boundary
+	_, err = r.Seek(lo, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	dec := &Decoder{r: bufio.NewReader(r), offset: lo}
+	for {
+		offset = dec.Offset()
+
+		var line *LogLine
+		line, err = dec.Decode()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		if !line.StartAt.Before(t) {
+			break
+		}
+	}
+
+	_, err = r.Seek(offset, io.SeekStart)
+
+	return
+}
+
+// resync is used to find the first valid log line starting at or after pos, it returns io.EOF if there is none
+func resync(r io.ReadSeeker, pos, size int64) (offset int64, line *LogLine, err error) {
+	buf := make([]byte, resyncWindow)
+
+	for pos+8 < size {
+		_, err = r.Seek(pos, io.SeekStart)
+		if err != nil {
+			return
+		}
+
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		err = nil
+		window := buf[:n]
+
+		// every candidate needs its 8 bytes length and its flag byte in the window
+		for i := 0; i+9 <= len(window); i++ {
+			offset = pos + int64(i)
+
+			line, err = lineAt(r, window[i:], offset, size)
+			if err != nil {
+				return
+			}
+			if line != nil {
+				return
+			}
+		}
+
+		pos += int64(len(window)) - 8
+	}
+
+	err = io.EOF
+
+	return
+}
+
+// lineAt is used to decode the log line at offset if it looks valid, head holds the bytes read from offset.
+// It returns a nil line without error if there is no valid log line at offset.
+func lineAt(r io.ReadSeeker, head []byte, offset, size int64) (line *LogLine, err error) {
+	n := binary.LittleEndian.Uint64(head)
+	if head[8] != ProxySQLQuery || n < minMessageLength || n > maxResyncMessageLength {
+		return
+	}
+
+	next := offset + 8 + int64(n)
+	if next > size {
+		return
+	}
+
+	var msg []byte
+	if uint64(len(head)) >= 8+n {
+		msg = head[8 : 8+n]
+	} else {
+		msg = make([]byte, n)
+
+		_, err = r.Seek(offset+8, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return
+		}
+	}
+
+	// the whole message must be consumed by its fields
+	candidate := &LogLine{MessageLength: n, RawMessage: msg}
+	buf := bytes.NewReader(msg)
+	if decodeMessage(candidate, buf) != nil || buf.Len() != 0 {
+		return
+	}
+
+	// and must be followed by the end of the log or by another log line header
+	if next < size {
+		nextHead := make([]byte, 9)
+
+		_, err = r.Seek(next, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(r, nextHead)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// a log line still being written
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		nn := binary.LittleEndian.Uint64(nextHead)
+		if nextHead[8] != ProxySQLQuery || nn < minMessageLength || next+8+int64(nn) > size {
+			return
+		}
+	}
+
+	// copy out of the window, it is reused
+	candidate.RawMessage = append([]byte{}, msg...)
+	line = candidate
+
+	return
+}
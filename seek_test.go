@@ -0,0 +1,70 @@
+package pxld
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeekTime(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+
+	// big enough to bisect a few times before decoding sequentially
+	data := &bytes.Buffer{}
+	offsets := []int64{}
+	for i := 0; i < 20000; i++ {
+		offsets = append(offsets, int64(data.Len()))
+		data.Write(encodeTestLine(uint64(i), base.Add(time.Duration(i)*time.Second), "select 1"))
+	}
+	r := bytes.NewReader(data.Bytes())
+
+	for _, i := range []int{0, 1, 7777, 12345, 19999} {
+		offset, err := SeekTime(r, base.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, offsets[i], offset)
+
+		l, err := NewDecoder(r).Decode()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), l.ThreadID)
+	}
+
+	// between two lines
+	offset, err := SeekTime(r, base.Add(100*time.Second+time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, offsets[101], offset)
+
+	// before and after everything
+	offset, err = SeekTime(r, base.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), offset)
+
+	offset, err = SeekTime(r, base.Add(time.Hour*24))
+	require.NoError(t, err)
+	require.Equal(t, int64(data.Len()), offset)
+}
+
+func TestResync(t *testing.T) {
+	base := time.Unix(1554883680, 0)
+	first := encodeTestLine(1, base, "select 1")
+	second := encodeTestLine(2, base, "select 2")
+	data := append(append([]byte{}, first...), second...)
+	r := bytes.NewReader(data)
+
+	offset, l, err := resync(r, 0, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), offset)
+	require.Equal(t, uint64(1), l.ThreadID)
+
+	// from the middle of the first line
+	offset, l, err = resync(r, 5, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(first)), offset)
+	require.Equal(t, uint64(2), l.ThreadID)
+
+	// from the middle of the last line
+	_, _, err = resync(r, int64(len(first)+5), int64(len(data)))
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,95 @@
+package pxld
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader is the header holding the signature of a request body, sha256= then the hex HMAC
+	SignatureHeader = "X-Pxld-Signature"
+	// TimestampHeader is the header holding the unix time in seconds a request body was signed at
+	TimestampHeader = "X-Pxld-Timestamp"
+	// DefaultSignatureTolerance is how old a signature can be by default, to limit replays
+	DefaultSignatureTolerance = 5 * time.Minute
+	// DefaultMaxSignedBodySize is a body size limit for VerifyRequest, like the decoder --max-body-size default
+	DefaultMaxSignedBodySize = 64 << 20
+
+	signaturePrefix = "sha256="
+)
+
+// Sign returns the signature of a body sent at a time, the HMAC-SHA256 of the unix timestamp, a dot then the body.
+// Signing the timestamp too keeps a captured request from being replayed later with a new timestamp.
+func Sign(secret []byte, at time.Time, body []byte) (signature, timestamp string) {
+	timestamp = strconv.FormatInt(at.Unix(), 10)
+
+	return signaturePrefix + hex.EncodeToString(signatureMAC(secret, timestamp, body)), timestamp
+}
+
+// VerifySignature checks that a body was signed with secret, by Sign or the decoder, at most tolerance ago
+func VerifySignature(secret []byte, signature, timestamp string, body []byte, tolerance time.Duration) error {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("invalid signature %q", signature)
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return fmt.Errorf("invalid signature %q", signature)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", timestamp)
+	}
+
+	at := time.Unix(unix, 0)
+	if age := time.Since(at); age > tolerance || age < -tolerance {
+		return fmt.Errorf("signature timestamp %s is out of tolerance", at.UTC().Format(time.RFC3339))
+	}
+
+	if !hmac.Equal(sum, signatureMAC(secret, timestamp, body)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
+
+// VerifyRequest checks the signature headers of a request then returns its body as sent,
+// still compressed when it has a Content-Encoding. The body is read in memory to be verified, so a body
+// larger than maxBodySize bytes is an error. The request body can be read again afterwards.
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration, maxBodySize int64) ([]byte, error) {
+	// a byte past the limit tells a body of exactly maxBodySize bytes from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	if int64(len(body)) > maxBodySize {
+		return nil, fmt.Errorf("request body is larger than %d bytes", maxBodySize)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = VerifySignature(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, tolerance)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func signatureMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
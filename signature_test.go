@@ -0,0 +1,82 @@
+package pxld
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	signature, timestamp := Sign([]byte("secret"), time.Unix(1554883680, 0), []byte("[]"))
+	require.Equal(t, "1554883680", timestamp)
+	// echo -n '1554883680.[]' | openssl dgst -sha256 -hmac secret
+	require.Equal(t, "sha256=096fa650ac1aaa44b9fd76bb0c166f111042e79d950d0fbc0f981ab106fbef2e", signature)
+}
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`[{"query":"select 1"}]`)
+
+	signature, timestamp := Sign(secret, time.Now(), body)
+	require.NoError(t, VerifySignature(secret, signature, timestamp, body, time.Minute))
+
+	// another secret or body
+	require.Error(t, VerifySignature([]byte("other"), signature, timestamp, body, time.Minute))
+	require.Error(t, VerifySignature(secret, signature, timestamp, []byte("[]"), time.Minute))
+
+	// the timestamp is signed too
+	later := strconv.FormatInt(time.Now().Unix()+1, 10)
+	require.Error(t, VerifySignature(secret, signature, later, body, time.Minute))
+
+	// too old or from the future
+	signature, timestamp = Sign(secret, time.Now().Add(-time.Hour), body)
+	require.Error(t, VerifySignature(secret, signature, timestamp, body, time.Minute))
+	signature, timestamp = Sign(secret, time.Now().Add(time.Hour), body)
+	require.Error(t, VerifySignature(secret, signature, timestamp, body, time.Minute))
+
+	signature, timestamp = Sign(secret, time.Now(), body)
+	require.Error(t, VerifySignature(secret, signature[len("sha256="):], timestamp, body, time.Minute))
+	require.Error(t, VerifySignature(secret, "sha256=zz", timestamp, body, time.Minute))
+	require.Error(t, VerifySignature(secret, signature, "now", body, time.Minute))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`[{"query":"select 1"}]`)
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	signature, timestamp := Sign(secret, time.Now(), body)
+	r.Header.Set(SignatureHeader, signature)
+	r.Header.Set(TimestampHeader, timestamp)
+
+	verified, err := VerifyRequest(r, secret, DefaultSignatureTolerance, DefaultMaxSignedBodySize)
+	require.NoError(t, err)
+	require.Equal(t, body, verified)
+
+	// the body can be read again
+	raw, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, raw)
+
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	_, err = VerifyRequest(r, secret, DefaultSignatureTolerance, DefaultMaxSignedBodySize)
+	require.Error(t, err)
+
+	// a body larger than the limit is not read in memory, a body at the limit is
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set(SignatureHeader, signature)
+	r.Header.Set(TimestampHeader, timestamp)
+	_, err = VerifyRequest(r, secret, DefaultSignatureTolerance, int64(len(body))-1)
+	require.Error(t, err)
+
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set(SignatureHeader, signature)
+	r.Header.Set(TimestampHeader, timestamp)
+	_, err = VerifyRequest(r, secret, DefaultSignatureTolerance, int64(len(body)))
+	require.NoError(t, err)
+}
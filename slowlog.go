@@ -0,0 +1,54 @@
+package pxld
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// SlowLogWriter writes log lines as MySQL slow query log entries, so pt-query-digest and mysqldumpslow can read them.
+// ProxySQL does not know about locks and rows, so Lock_time, Rows_sent and Rows_examined are always 0.
+type SlowLogWriter struct {
+	w io.Writer
+}
+
+// NewSlowLogWriter returns a new writer that writes to w
+func NewSlowLogWriter(w io.Writer) *SlowLogWriter {
+	return &SlowLogWriter{w: w}
+}
+
+// Write writes a log line as a single slow query log entry
+func (w *SlowLogWriter) Write(l *LogLine) error {
+	host := l.ClientAddr
+	if h, _, err := net.SplitHostPort(l.ClientAddr); err == nil {
+		host = h
+	}
+
+	buf := &bytes.Buffer{}
+
+	// MySQL writes an entry when its query ends
+	fmt.Fprintf(buf, "# Time: %s\n", l.EndAt.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(buf, "# User@Host: %s[%s] @  [%s]  Id: %d\n", l.Username, l.Username, host, l.ThreadID)
+	fmt.Fprintf(buf, "# Query_time: %.6f  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0\n", l.Duration.Seconds())
+	if l.Schema != "" {
+		fmt.Fprintf(buf, "use %s;\n", l.Schema)
+	}
+	fmt.Fprintf(buf, "SET timestamp=%d;\n", l.StartAt.Unix())
+
+	buf.WriteString(l.Query)
+	if !strings.HasSuffix(strings.TrimSpace(l.Query), ";") {
+		buf.WriteByte(';')
+	}
+	buf.WriteByte('\n')
+
+	_, err := buf.WriteTo(w.w)
+
+	return err
+}
+
+// Close does nothing as nothing is buffered
+func (w *SlowLogWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package pxld
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowLogWriter(t *testing.T) {
+	l := &LogLine{
+		ThreadID:   21,
+		Username:   "didasy",
+		Schema:     "test",
+		ClientAddr: "127.0.0.1:33680",
+		StartAt:    time.Unix(1554883680, 727354000),
+		EndAt:      time.Unix(1554883682, 227354000),
+		Duration:   1500 * time.Millisecond,
+		Query:      "select *\nfrom test",
+	}
+
+	noSchema := *l
+	noSchema.Schema = ""
+	noSchema.Query = "select 1;"
+
+	buf := &bytes.Buffer{}
+	w := NewSlowLogWriter(buf)
+	require.NoError(t, w.Write(l))
+	require.NoError(t, w.Write(&noSchema))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, `# Time: 2019-04-10T08:08:02.227354Z
+# User@Host: didasy[didasy] @  [127.0.0.1]  Id: 21
+# Query_time: 1.500000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+use test;
+SET timestamp=1554883680;
+select *
+from test;
+# Time: 2019-04-10T08:08:02.227354Z
+# User@Host: didasy[didasy] @  [127.0.0.1]  Id: 21
+# Query_time: 1.500000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1554883680;
+select 1;
+`, buf.String())
+}
@@ -0,0 +1,317 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// SQLDialectMySQL writes batched INSERT statements
+	SQLDialectMySQL = "mysql"
+	// SQLDialectPostgreSQL writes a COPY ... FROM STDIN stream
+	SQLDialectPostgreSQL = "postgresql"
+
+	// DefaultSQLBatchSize is the default number of rows of an INSERT statement
+	DefaultSQLBatchSize = 1000
+
+	// sqlTimeLayout is understood by both dialects, times are written in UTC
+	sqlTimeLayout = "2006-01-02 15:04:05.000000"
+)
+
+var (
+	// sqlColumns are the columns written by SQLWriter, in order, all named after the JSON fields
+	sqlColumns = []string{
+		"thread_id", "username", "schema", "client_addr", "hid", "server_addr",
+		"start_at", "end_at", "duration_ns", "query_digest", "query",
+	}
+
+	sqlCreateTables = map[string]string{
+		// written with double quotes for readability, MySQL quotes identifiers with backquotes
+		SQLDialectMySQL: strings.Replace(`CREATE TABLE IF NOT EXISTS %[1]s (
+  "id" BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  "thread_id" BIGINT UNSIGNED NOT NULL,
+  "username" VARCHAR(255) NOT NULL,
+  "schema" VARCHAR(255) NOT NULL,
+  "client_addr" VARCHAR(255) NOT NULL,
+  "hid" BIGINT UNSIGNED NULL,
+  "server_addr" VARCHAR(255) NOT NULL,
+  "start_at" DATETIME(6) NOT NULL,
+  "end_at" DATETIME(6) NOT NULL,
+  "duration_ns" BIGINT NOT NULL,
+  "query_digest" VARCHAR(18) NOT NULL,
+  "query" LONGTEXT NOT NULL,
+  KEY %[2]s ("start_at"),
+  KEY %[3]s ("query_digest", "start_at"),
+  KEY %[4]s ("username")
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+`, `"`, "`", -1),
+		SQLDialectPostgreSQL: `CREATE TABLE IF NOT EXISTS %[1]s (
+  "id" BIGSERIAL PRIMARY KEY,
+  "thread_id" BIGINT NOT NULL,
+  "username" TEXT NOT NULL,
+  "schema" TEXT NOT NULL,
+  "client_addr" TEXT NOT NULL,
+  "hid" BIGINT NULL,
+  "server_addr" TEXT NOT NULL,
+  "start_at" TIMESTAMPTZ NOT NULL,
+  "end_at" TIMESTAMPTZ NOT NULL,
+  "duration_ns" BIGINT NOT NULL,
+  "query_digest" TEXT NOT NULL,
+  "query" TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("start_at");
+CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s ("query_digest", "start_at");
+CREATE INDEX IF NOT EXISTS %[4]s ON %[1]s ("username");
+`,
+	}
+)
+
+// SQLWriter writes log lines as a SQL script loading them into a table, either batched INSERT statements
+// of MySQL or a COPY ... FROM STDIN stream of PostgreSQL, e.g. for the mysql or psql clients.
+// Times are written in UTC, and the HID is NULL when there is no server.
+// Close must be called to end the last statement.
+type SQLWriter struct {
+	// BatchSize is the number of rows of a MySQL INSERT statement, DefaultSQLBatchSize when not positive
+	BatchSize int
+	// CreateTable writes the CREATE TABLE statement of SQLCreateTable first
+	CreateTable bool
+
+	w       io.Writer
+	dialect string
+	table   string
+
+	started bool
+	rows    int
+}
+
+// NewSQLWriter returns a new writer that writes a script of a dialect to w, loading the log lines into table,
+// which may be prefixed by its database or schema
+func NewSQLWriter(w io.Writer, dialect, table string) (*SQLWriter, error) {
+	if _, ok := sqlCreateTables[dialect]; !ok {
+		return nil, fmt.Errorf("unknown sql dialect %s", dialect)
+	}
+	if table == "" {
+		return nil, fmt.Errorf("the sql table is empty")
+	}
+
+	return &SQLWriter{w: w, dialect: dialect, table: table}, nil
+}
+
+// SQLCreateTable returns the CREATE TABLE statement of table in a dialect matching what SQLWriter writes,
+// with indexes on the start time, the digest and the username
+func SQLCreateTable(dialect, table string) (string, error) {
+	ddl, ok := sqlCreateTables[dialect]
+	if !ok {
+		return "", fmt.Errorf("unknown sql dialect %s", dialect)
+	}
+
+	name := table[strings.LastIndexByte(table, '.')+1:]
+
+	return fmt.Sprintf(ddl,
+		quoteSQLIdent(dialect, table),
+		quoteSQLIdent(dialect, name+"_start_at"),
+		quoteSQLIdent(dialect, name+"_query_digest"),
+		quoteSQLIdent(dialect, name+"_username"),
+	), nil
+}
+
+// Write writes a log line as a row of the current statement, starting a new one when needed
+func (w *SQLWriter) Write(l *LogLine) error {
+	buf := &bytes.Buffer{}
+
+	err := w.start(buf)
+	if err != nil {
+		return err
+	}
+
+	hid := ""
+	if l.HID != math.MaxUint64 {
+		hid = strconv.FormatUint(l.HID, 10)
+	}
+
+	values := []string{
+		strconv.FormatUint(l.ThreadID, 10),
+		l.Username,
+		l.Schema,
+		l.ClientAddr,
+		hid,
+		l.ServerAddr,
+		l.StartAt.UTC().Format(sqlTimeLayout),
+		l.EndAt.UTC().Format(sqlTimeLayout),
+		strconv.FormatInt(int64(l.Duration), 10),
+		l.QueryDigest,
+		l.Query,
+	}
+
+	if w.dialect == SQLDialectPostgreSQL {
+		w.writeCopyRow(buf, values)
+	} else {
+		w.writeInsertRow(buf, values)
+	}
+
+	_, err = buf.WriteTo(w.w)
+
+	return err
+}
+
+// Close ends the current statement, only writing the CREATE TABLE statement if nothing was written
+func (w *SQLWriter) Close() error {
+	buf := &bytes.Buffer{}
+
+	err := w.start(buf)
+	if err != nil {
+		return err
+	}
+
+	if w.rows > 0 {
+		if w.dialect == SQLDialectPostgreSQL {
+			buf.WriteString("\\.\n")
+		} else {
+			buf.WriteString(";\n")
+		}
+		w.rows = 0
+	}
+
+	_, err = buf.WriteTo(w.w)
+
+	return err
+}
+
+// start writes the CREATE TABLE statement once
+func (w *SQLWriter) start(buf *bytes.Buffer) error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	if !w.CreateTable {
+		return nil
+	}
+
+	ddl, err := SQLCreateTable(w.dialect, w.table)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(ddl)
+
+	return nil
+}
+
+func (w *SQLWriter) columns() string {
+	quoted := make([]string, len(sqlColumns))
+	for i, c := range sqlColumns {
+		quoted[i] = quoteSQLIdent(w.dialect, c)
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+func (w *SQLWriter) writeInsertRow(buf *bytes.Buffer, values []string) {
+	if w.rows == 0 {
+		fmt.Fprintf(buf, "INSERT INTO %s (%s) VALUES\n(", quoteSQLIdent(w.dialect, w.table), w.columns())
+	} else {
+		buf.WriteString(",\n(")
+	}
+
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		switch sqlColumns[i] {
+		case "thread_id", "duration_ns":
+			buf.WriteString(v)
+		case "hid":
+			if v == "" {
+				v = "NULL"
+			}
+			buf.WriteString(v)
+		default:
+			buf.WriteString(quoteMySQLString(v))
+		}
+	}
+	buf.WriteByte(')')
+
+	w.rows++
+
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultSQLBatchSize
+	}
+	if w.rows >= batchSize {
+		buf.WriteString(";\n")
+		w.rows = 0
+	}
+}
+
+func (w *SQLWriter) writeCopyRow(buf *bytes.Buffer, values []string) {
+	if w.rows == 0 {
+		fmt.Fprintf(buf, "COPY %s (%s) FROM STDIN;\n", quoteSQLIdent(w.dialect, w.table), w.columns())
+	}
+
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+
+		switch sqlColumns[i] {
+		case "hid":
+			if v == "" {
+				v = `\N`
+			}
+			buf.WriteString(v)
+		case "start_at", "end_at":
+			buf.WriteString(v + "+00")
+		default:
+			buf.WriteString(escapeCopyText(v))
+		}
+	}
+	buf.WriteByte('\n')
+
+	w.rows++
+}
+
+// quoteSQLIdent quotes every dot separated part of an identifier
+func quoteSQLIdent(dialect, ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, p := range parts {
+		if dialect == SQLDialectPostgreSQL {
+			parts[i] = `"` + strings.Replace(p, `"`, `""`, -1) + `"`
+		} else {
+			parts[i] = "`" + strings.Replace(p, "`", "``", -1) + "`"
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// quoteMySQLString quotes s so it reads the same whatever the sql_mode, NO_BACKSLASH_ESCAPES changing
+// what a backslash means in a quoted string. Strings with backslashes or bytes that are not printable UTF-8
+// are written as hex literals instead.
+func quoteMySQLString(s string) string {
+	if !utf8.ValidString(s) || strings.ContainsAny(s, "\\\x00\x1a") {
+		return "X'" + hex.EncodeToString([]byte(s)) + "'"
+	}
+
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// escapeCopyText escapes s for the text format of COPY. PostgreSQL text can not contain NUL nor invalid UTF-8,
+// so NULs are dropped and invalid bytes replaced by U+FFFD.
+func escapeCopyText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		"\t", "\\t",
+		"\n", "\\n",
+		"\r", "\\r",
+		"\x00", "",
+	).Replace(s)
+}
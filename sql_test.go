@@ -0,0 +1,113 @@
+package pxld
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLWriterMySQL(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	tricky := *line
+	tricky.HID = math.MaxUint64
+	tricky.ServerAddr = ""
+	tricky.Query = "select 'it''s'\nfrom `t`"
+
+	binary := *line
+	binary.Query = "select '\\'"
+
+	buf := &bytes.Buffer{}
+	w, err := NewSQLWriter(buf, SQLDialectMySQL, "logs.queries")
+	require.NoError(t, err)
+	w.BatchSize = 2
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Write(&tricky))
+	require.NoError(t, w.Write(&binary))
+	require.NoError(t, w.Close())
+
+	columns := "(`thread_id`, `username`, `schema`, `client_addr`, `hid`, `server_addr`, `start_at`, `end_at`, `duration_ns`, `query_digest`, `query`)"
+	require.Equal(t, "INSERT INTO `logs`.`queries` "+columns+" VALUES\n"+
+		"(21, 'didasy', 'test', '127.0.0.1:33680', 1, '127.0.0.1:3306', '2019-04-10 08:08:00.727354', '2019-04-10 08:08:00.727354', 0, '0x426F13B3371DDF38', 'select * from test'),\n"+
+		"(21, 'didasy', 'test', '127.0.0.1:33680', NULL, '', '2019-04-10 08:08:00.727354', '2019-04-10 08:08:00.727354', 0, '0x426F13B3371DDF38', 'select ''it''''s''\nfrom `t`');\n"+
+		"INSERT INTO `logs`.`queries` "+columns+" VALUES\n"+
+		"(21, 'didasy', 'test', '127.0.0.1:33680', 1, '127.0.0.1:3306', '2019-04-10 08:08:00.727354', '2019-04-10 08:08:00.727354', 0, '0x426F13B3371DDF38', X'73656c65637420275c27');\n",
+		buf.String())
+}
+
+func TestSQLWriterPostgreSQL(t *testing.T) {
+	tm, _ := time.Parse(time.RFC3339, "2019-04-10T15:08:00.727354+07:00")
+	line.StartAt = tm
+	line.EndAt = tm
+
+	tricky := *line
+	tricky.HID = math.MaxUint64
+	tricky.Query = "select '\\'\tfrom\r\nt\x00\xff"
+
+	buf := &bytes.Buffer{}
+	w, err := NewSQLWriter(buf, SQLDialectPostgreSQL, "queries")
+	require.NoError(t, err)
+	w.CreateTable = true
+	require.NoError(t, w.Write(line))
+	require.NoError(t, w.Write(&tricky))
+	require.NoError(t, w.Close())
+
+	ddl, err := SQLCreateTable(SQLDialectPostgreSQL, "queries")
+	require.NoError(t, err)
+
+	require.Equal(t, ddl+
+		"COPY \"queries\" (\"thread_id\", \"username\", \"schema\", \"client_addr\", \"hid\", \"server_addr\", \"start_at\", \"end_at\", \"duration_ns\", \"query_digest\", \"query\") FROM STDIN;\n"+
+		"21\tdidasy\ttest\t127.0.0.1:33680\t1\t127.0.0.1:3306\t2019-04-10 08:08:00.727354+00\t2019-04-10 08:08:00.727354+00\t0\t0x426F13B3371DDF38\tselect * from test\n"+
+		"21\tdidasy\ttest\t127.0.0.1:33680\t\\N\t127.0.0.1:3306\t2019-04-10 08:08:00.727354+00\t2019-04-10 08:08:00.727354+00\t0\t0x426F13B3371DDF38\tselect '\\\\'\\tfrom\\r\\nt\uFFFD\n"+
+		"\\.\n",
+		buf.String())
+}
+
+func TestSQLWriterEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewSQLWriter(buf, SQLDialectMySQL, "queries")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Empty(t, buf.String())
+
+	w, err = NewSQLWriter(buf, SQLDialectMySQL, "queries")
+	require.NoError(t, err)
+	w.CreateTable = true
+	require.NoError(t, w.Close())
+	require.True(t, strings.HasPrefix(buf.String(), "CREATE TABLE IF NOT EXISTS `queries` (\n"))
+}
+
+func TestSQLCreateTable(t *testing.T) {
+	ddl, err := SQLCreateTable(SQLDialectMySQL, "logs.queries")
+	require.NoError(t, err)
+	require.Contains(t, ddl, "CREATE TABLE IF NOT EXISTS `logs`.`queries` (\n")
+	require.Contains(t, ddl, "  KEY `queries_query_digest` (`query_digest`, `start_at`),\n")
+	require.NotContains(t, ddl, `"`)
+
+	ddl, err = SQLCreateTable(SQLDialectPostgreSQL, "logs.queries")
+	require.NoError(t, err)
+	require.Contains(t, ddl, "CREATE TABLE IF NOT EXISTS \"logs\".\"queries\" (\n")
+	require.Contains(t, ddl, "CREATE INDEX IF NOT EXISTS \"queries_username\" ON \"logs\".\"queries\" (\"username\");\n")
+
+	// every written column is in the table
+	for _, c := range sqlColumns {
+		require.Contains(t, ddl, `"`+c+`" `)
+	}
+}
+
+func TestSQLWriterNegative(t *testing.T) {
+	_, err := NewSQLWriter(&bytes.Buffer{}, "oracle", "queries")
+	require.Error(t, err)
+
+	_, err = NewSQLWriter(&bytes.Buffer{}, SQLDialectMySQL, "")
+	require.Error(t, err)
+
+	_, err = SQLCreateTable("oracle", "queries")
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package pxld
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// templateFuncs are the functions of TemplateWriter templates, on top of the text/template ones
+	templateFuncs = template.FuncMap{
+		"truncate":   templateTruncate,
+		"oneline":    templateOneline,
+		"formatTime": templateFormatTime,
+		"utc":        func(t time.Time) time.Time { return t.UTC() },
+		"json":       templateJSON,
+	}
+)
+
+// TemplateWriter writes every log line with a text/template, followed by a newline unless the template ends with one.
+// The template is executed with the LogLine, so fields are used like {{.Username}}, and it can use these functions:
+//
+//   - truncate n s cuts s to at most n characters, ending with ... when cut, e.g. {{.Query | truncate 80}}
+//   - oneline s replaces every sequence of white spaces of s, line breaks included, by a single space
+//   - formatTime layout t formats t with a Go time layout or one of the TimeFormat constants, e.g. {{.StartAt | formatTime "15:04:05"}}
+//   - utc t returns t in UTC
+//   - json v encodes v as compact JSON, e.g. a quoted and escaped string with {{json .Query}}
+type TemplateWriter struct {
+	w       io.Writer
+	tmpl    *template.Template
+	newline bool
+}
+
+// NewTemplateWriter parses text as a template then returns a new writer that writes to w.
+// A syntax error or an unknown function is an error here, a misspelled field is only one on Write.
+func NewTemplateWriter(w io.Writer, text string) (*TemplateWriter, error) {
+	tmpl, err := template.New("line").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	return &TemplateWriter{w: w, tmpl: tmpl, newline: !strings.HasSuffix(text, "\n")}, nil
+}
+
+// Write writes a log line with the template
+func (w *TemplateWriter) Write(l *LogLine) error {
+	buf := &bytes.Buffer{}
+
+	err := w.tmpl.Execute(buf, l)
+	if err != nil {
+		return err
+	}
+	if w.newline {
+		buf.WriteByte('\n')
+	}
+
+	_, err = buf.WriteTo(w.w)
+
+	return err
+}
+
+// Close does nothing as nothing is buffered
+func (w *TemplateWriter) Close() error {
+	return nil
+}
+
+func templateTruncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	if n <= 3 {
+		return string([]rune(s)[:n])
+	}
+
+	return string([]rune(s)[:n-3]) + "..."
+}
+
+func templateOneline(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func templateFormatTime(layout string, t time.Time) string {
+	return FormatTime(t, layout)
+}
+
+func templateJSON(v interface{}) (string, error) {
+	buf := &bytes.Buffer{}
+
+	enc := json.NewEncoder(buf)
+	// queries are full of < and >, keep them readable
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(v)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,60 @@
+package pxld
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateWriter(t *testing.T) {
+	l := &LogLine{
+		ThreadID: 21,
+		Username: "didasy",
+		StartAt:  time.Unix(1554883680, 727354000),
+		Duration: 1500 * time.Millisecond,
+		Query:    "select \"<a>\"\n  from   test",
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := NewTemplateWriter(buf, `{{.StartAt | utc | formatTime "2006-01-02 15:04:05"}} {{.Username}} {{.Duration}} {{.Query | oneline | truncate 20}} {{json .Query}} {{.StartAt | formatTime "unix"}}`)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(l))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, `2019-04-10 08:08:00 didasy 1.5s select "<a>" from... "select \"<a>\"\n  from   test" 1554883680`+"\n", buf.String())
+
+	// a template ending with a newline gets no other
+	buf.Reset()
+	w, err = NewTemplateWriter(buf, "{{.ThreadID}}\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Write(l))
+	require.Equal(t, "21\n", buf.String())
+
+	// a template failing on some lines only, like slicing a short query, is valid
+	buf.Reset()
+	w, err = NewTemplateWriter(buf, "{{slice .Query 0 6}}")
+	require.NoError(t, err)
+	require.NoError(t, w.Write(l))
+	require.Equal(t, "select\n", buf.String())
+}
+
+func TestTemplateTruncate(t *testing.T) {
+	require.Equal(t, "select", templateTruncate(6, "select"))
+	require.Equal(t, "sel...", templateTruncate(6, "select 1"))
+	require.Equal(t, "sé", templateTruncate(2, "séléct"))
+}
+
+func TestTemplateWriterNegative(t *testing.T) {
+	_, err := NewTemplateWriter(&bytes.Buffer{}, "{{.Username")
+	require.Error(t, err)
+
+	// a misspelled field fails on Write
+	w, err := NewTemplateWriter(&bytes.Buffer{}, "{{.User}}")
+	require.NoError(t, err)
+	require.Error(t, w.Write(&LogLine{}))
+
+	_, err = NewTemplateWriter(&bytes.Buffer{}, "{{.Query | nope}}")
+	require.Error(t, err)
+}
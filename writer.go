@@ -0,0 +1,9 @@
+package pxld
+
+// Writer is implemented by every encoder of log lines
+type Writer interface {
+	// Write encodes a single log line
+	Write(l *LogLine) error
+	// Close flushes anything still buffered, it does not close the underlying output
+	Close() error
+}